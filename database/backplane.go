@@ -0,0 +1,168 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/websockets"
+	"github.com/lib/pq"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	notifyChannel    = "websocket_hub"
+	maxNotifyPayload = 8000 // Postgres rejects bigger NOTIFY payloads
+
+	// Bigger envelopes are stored in a table and only their id is notified, with this prefix
+	storedEnvelopePrefix = "stored:"
+
+	// Stored envelopes are read as soon as they are notified, so they are deleted after this long
+	storedEnvelopeTTL = 5 * time.Minute
+)
+
+// Websocket hub backplane using Postgres LISTEN/NOTIFY, so every replica delivers the messages
+type PostgresBackplane struct {
+	db       *sql.DB
+	listener *pq.Listener
+}
+
+func NewPostgresBackplane(url string) (*PostgresBackplane, error) {
+	db, err := sql.Open("postgres", url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	listener := pq.NewListener(url, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Backplane listener:", err)
+		}
+	})
+
+	if err := listener.Listen(notifyChannel); err != nil {
+		listener.Close()
+		db.Close()
+		return nil, err
+	}
+
+	return &PostgresBackplane{
+		db:       db,
+		listener: listener,
+	}, nil
+}
+
+func (b *PostgresBackplane) Publish(ctx context.Context, envelope *websockets.Envelope) error {
+	data, err := json.Marshal(envelope)
+
+	if err != nil {
+		return err
+	}
+
+	payload := string(data)
+
+	if len(data) > maxNotifyPayload {
+		if payload, err = b.store(ctx, data); err != nil {
+			return err
+		}
+	}
+
+	_, err = b.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", notifyChannel, payload)
+	return err
+}
+
+// Stores an envelope too big for a notification, returning the payload to notify instead
+func (b *PostgresBackplane) store(ctx context.Context, data []byte) (string, error) {
+	id, err := ksuid.NewRandom()
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := b.db.ExecContext(ctx, "INSERT INTO backplane_envelopes (id, envelope) VALUES ($1, $2)", id.String(), string(data)); err != nil {
+		return "", err
+	}
+
+	// Every replica has read the old ones by now
+	_, err = b.db.ExecContext(
+		ctx,
+		"DELETE FROM backplane_envelopes WHERE created_at < NOW() - make_interval(secs => $1)",
+		storedEnvelopeTTL.Seconds(),
+	)
+
+	if err != nil {
+		log.Println("Could not delete the old backplane envelopes:", err)
+	}
+
+	return storedEnvelopePrefix + id.String(), nil
+}
+
+// Decodes the envelope of a notification, reading it from the table when it was stored
+func (b *PostgresBackplane) load(payload string) (*websockets.Envelope, error) {
+	data := []byte(payload)
+
+	if strings.HasPrefix(payload, storedEnvelopePrefix) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var stored string
+		id := strings.TrimPrefix(payload, storedEnvelopePrefix)
+
+		if err := b.db.QueryRowContext(ctx, "SELECT envelope FROM backplane_envelopes WHERE id = $1", id).Scan(&stored); err != nil {
+			return nil, fmt.Errorf("stored envelope %s: %w", id, err)
+		}
+
+		data = []byte(stored)
+	}
+
+	var envelope websockets.Envelope
+
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+
+	return &envelope, nil
+}
+
+func (b *PostgresBackplane) Subscribe(handler func(envelope *websockets.Envelope)) error {
+	go func() {
+		for {
+			select {
+			case notification, ok := <-b.listener.Notify:
+				if !ok {
+					return // The listener was closed
+				}
+
+				if notification == nil {
+					continue // Sent after the listener reconnects, messages in between are lost
+				}
+
+				envelope, err := b.load(notification.Extra)
+
+				if err != nil {
+					log.Println("Backplane message:", err)
+					continue
+				}
+
+				handler(envelope)
+			case <-time.After(90 * time.Second):
+				// Checks the connection is still alive when there is no traffic
+				go b.listener.Ping()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (b *PostgresBackplane) Close() error {
+	if err := b.listener.Close(); err != nil {
+		return err
+	}
+
+	return b.db.Close()
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"log"
+	"time"
 
 	"github.com/daluisgarcia/golang-rest-websockets/models"
 	_ "github.com/lib/pq"
@@ -123,17 +124,27 @@ func (repo *PostgresRepository) FindPostById(ctx context.Context, id string) (*m
 		return nil, err
 	}
 
-	return &post, nil
+	return nil, nil // The post does not exist
 }
 
-func (repo *PostgresRepository) UpdatePost(ctx context.Context, post *models.Post) error {
-	_, err := repo.db.ExecContext(ctx, "UPDATE posts SET post_content = $1 WHERE id = $2 AND user_id = $3", post.PostContent, post.Id, post.UserId)
-	return err
+func (repo *PostgresRepository) UpdatePost(ctx context.Context, post *models.Post) (int64, error) {
+	result, err := repo.db.ExecContext(ctx, "UPDATE posts SET post_content = $1 WHERE id = $2 AND user_id = $3", post.PostContent, post.Id, post.UserId)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
 }
 
-func (repo *PostgresRepository) DeletePost(ctx context.Context, id string, userId string) error {
-	_, err := repo.db.ExecContext(ctx, "DELETE FROM posts WHERE id = $1 AND user_id = $2", id, userId)
-	return err
+func (repo *PostgresRepository) DeletePost(ctx context.Context, id string, userId string) (int64, error) {
+	result, err := repo.db.ExecContext(ctx, "DELETE FROM posts WHERE id = $1 AND user_id = $2", id, userId)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
 }
 
 func (repo *PostgresRepository) ListPosts(ctx context.Context, page uint64, userId string) ([]*models.Post, error) {
@@ -174,3 +185,169 @@ func (repo *PostgresRepository) ListPosts(ctx context.Context, page uint64, user
 
 	return posts, nil
 }
+
+func (repo *PostgresRepository) InsertRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	_, err := repo.db.ExecContext(
+		ctx,
+		"INSERT INTO refresh_tokens (id, family_id, user_id, token_hash, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		token.Id, token.FamilyId, token.UserId, token.TokenHash, token.ExpiresAt,
+	)
+	return err
+}
+
+func (repo *PostgresRepository) FindRefreshTokenByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	var token = models.RefreshToken{}
+	err := repo.db.QueryRowContext(
+		ctx,
+		"SELECT id, family_id, user_id, token_hash, expires_at, created_at, used_at, replaced_by, revoked_at FROM refresh_tokens WHERE token_hash = $1",
+		tokenHash,
+	).Scan(&token.Id, &token.FamilyId, &token.UserId, &token.TokenHash, &token.ExpiresAt, &token.CreatedAt, &token.UsedAt, &token.ReplacedBy, &token.RevokedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil // The token does not exist
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (repo *PostgresRepository) RotateRefreshToken(ctx context.Context, usedId string, next *models.RefreshToken) (bool, error) {
+	tx, err := repo.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer tx.Rollback() // Does nothing once committed
+
+	// Only one of the concurrent refreshes with the same token updates it, the rest find it used
+	result, err := tx.ExecContext(
+		ctx,
+		"UPDATE refresh_tokens SET used_at = NOW(), replaced_by = $2 WHERE id = $1 AND used_at IS NULL AND revoked_at IS NULL",
+		usedId, next.Id,
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	if exchanged, err := result.RowsAffected(); err != nil || exchanged == 0 {
+		return false, err
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO refresh_tokens (id, family_id, user_id, token_hash, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		next.Id, next.FamilyId, next.UserId, next.TokenHash, next.ExpiresAt,
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (repo *PostgresRepository) RevokeRefreshTokenFamily(ctx context.Context, familyId string) error {
+	_, err := repo.db.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL", familyId)
+	return err
+}
+
+func (repo *PostgresRepository) RevokeUserRefreshTokens(ctx context.Context, userId string) error {
+	_, err := repo.db.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userId)
+	return err
+}
+
+func (repo *PostgresRepository) InsertRevokedToken(ctx context.Context, tokenId string, userId string, expiresAt time.Time) error {
+	_, err := repo.db.ExecContext(
+		ctx,
+		"INSERT INTO revoked_tokens (id, user_id, expires_at) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING",
+		tokenId, userId, expiresAt,
+	)
+	return err
+}
+
+func (repo *PostgresRepository) IsTokenIdRevoked(ctx context.Context, tokenId string) (bool, error) {
+	var revoked bool
+	err := repo.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE id = $1)", tokenId).Scan(&revoked)
+	return revoked, err
+}
+
+// Returns how many revoked tokens were deleted
+func (repo *PostgresRepository) DeleteRevokedTokensExpiredBefore(ctx context.Context, before time.Time) (int64, error) {
+	result, err := repo.db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < $1", before)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Returns the new generation, the first one of a user is 1
+func (repo *PostgresRepository) IncrementUserTokenGeneration(ctx context.Context, userId string) (int64, error) {
+	var generation int64
+	err := repo.db.QueryRowContext(
+		ctx,
+		"INSERT INTO user_token_generations (user_id, generation) VALUES ($1, 1) ON CONFLICT (user_id) DO UPDATE SET generation = user_token_generations.generation + 1 RETURNING generation",
+		userId,
+	).Scan(&generation)
+	return generation, err
+}
+
+// Returns 0 when the tokens of the user were never revoked
+func (repo *PostgresRepository) FindUserTokenGeneration(ctx context.Context, userId string) (int64, error) {
+	var generation int64
+	err := repo.db.QueryRowContext(ctx, "SELECT generation FROM user_token_generations WHERE user_id = $1", userId).Scan(&generation)
+
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return generation, err
+}
+
+func (repo *PostgresRepository) InsertSigningKey(ctx context.Context, key *models.SigningKey) error {
+	_, err := repo.db.ExecContext(
+		ctx,
+		"INSERT INTO signing_keys (id, algorithm, private_key, created_at) VALUES ($1, $2, $3, $4)",
+		key.Id, key.Algorithm, key.PrivateKey, key.CreatedAt,
+	)
+	return err
+}
+
+func (repo *PostgresRepository) ListSigningKeys(ctx context.Context, algorithm string, limit int) ([]*models.SigningKey, error) {
+	rows, err := repo.db.QueryContext(
+		ctx,
+		"SELECT id, algorithm, private_key, created_at FROM signing_keys WHERE algorithm = $1 ORDER BY created_at DESC LIMIT $2",
+		algorithm, limit,
+	)
+
+	// Checked before closing the rows, which are nil when the query fails
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var keys []*models.SigningKey
+	for rows.Next() {
+		var key = models.SigningKey{}
+
+		// A key that can not be read must fail the loading, instead of signing with an older one
+		if err := rows.Scan(&key.Id, &key.Algorithm, &key.PrivateKey, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -15,4 +15,62 @@ CREATE TABLE posts (
 	user_id varchar(36) NOT NULL,
 	created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	FOREIGN KEY (user_id) REFERENCES users(id)
-)
+);
+
+DROP TABLE IF EXISTS "refresh_tokens";
+
+CREATE TABLE refresh_tokens (
+	id varchar(36) NOT NULL PRIMARY KEY,
+	family_id varchar(36) NOT NULL,
+	user_id varchar(36) NOT NULL,
+	token_hash varchar(64) UNIQUE NOT NULL,
+	expires_at timestamp NOT NULL,
+	created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	used_at timestamp,
+	replaced_by varchar(36),
+	revoked_at timestamp,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+DROP TABLE IF EXISTS "revoked_tokens";
+
+-- Access tokens revoked before they expire, the expired ones can be deleted
+CREATE TABLE revoked_tokens (
+	id varchar(36) NOT NULL PRIMARY KEY,
+	user_id varchar(36) NOT NULL,
+	expires_at timestamp NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+DROP TABLE IF EXISTS "user_token_generations";
+
+-- Access tokens of the user issued with an older generation are revoked, like when logging out of all the sessions
+CREATE TABLE user_token_generations (
+	user_id varchar(36) NOT NULL PRIMARY KEY,
+	generation bigint NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+DROP TABLE IF EXISTS "signing_keys";
+
+-- Keys used to sign the access tokens, the newest activated one of the algorithm signs and the rest only verify.
+-- The private keys are encrypted with JWT_KEY_ENCRYPTION_KEY, since anyone reading them could forge tokens
+CREATE TABLE signing_keys (
+	id varchar(36) NOT NULL PRIMARY KEY,
+	algorithm varchar(16) NOT NULL,
+	private_key bytea NOT NULL,
+	created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+DROP TABLE IF EXISTS "backplane_envelopes";
+
+-- Websocket hub messages too big for a NOTIFY payload, the replicas read them by id
+CREATE TABLE backplane_envelopes (
+	id varchar(36) NOT NULL PRIMARY KEY,
+	envelope text NOT NULL,
+	created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX backplane_envelopes_created_at_idx ON backplane_envelopes (created_at);
@@ -3,12 +3,19 @@ module github.com/daluisgarcia/golang-rest-websockets
 go 1.19
 
 require (
-	github.com/golang-jwt/jwt/v4 v4.4.2 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
-	github.com/joho/godotenv v1.4.0 // indirect
-	github.com/lib/pq v1.10.7 // indirect
-	github.com/rs/cors v1.8.2 // indirect
-	github.com/segmentio/ksuid v1.0.4 // indirect
-	golang.org/x/crypto v0.3.0 // indirect
+	github.com/fxamacker/cbor/v2 v2.7.0
+	github.com/golang-jwt/jwt/v4 v4.4.2
+	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.5.0
+	github.com/joho/godotenv v1.4.0
+	github.com/lib/pq v1.10.7
+	github.com/rs/cors v1.8.2
+	github.com/segmentio/ksuid v1.0.4
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	golang.org/x/crypto v0.3.0
+)
+
+require (
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 )
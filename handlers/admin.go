@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/server"
+	"github.com/daluisgarcia/golang-rest-websockets/websockets"
+	"github.com/gorilla/mux"
+)
+
+// Time the replicas have to list their connections
+const listConnectionsTimeout = 2 * time.Second
+
+// Connections of every replica, by replica
+type ConnectionsResponse struct {
+	Nodes   []websockets.NodeClients `json:"nodes"`
+	Missing []string                 `json:"missing"` // Replicas that did not answer in time, so their connections are not listed
+}
+
+type AnnouncementRequest struct {
+	Message string `json:"message"`
+}
+
+// Lists the websocket and event stream connections open to every replica
+func ListConnectionsHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), listConnectionsTimeout)
+		defer cancel()
+
+		nodes, missing := s.Hub().ClusterClients(ctx)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ConnectionsResponse{
+			Nodes:   nodes,
+			Missing: missing,
+		})
+	}
+}
+
+// Closes the connection on whichever replica it is open, which happens right after replying
+func DisconnectClientHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		s.Hub().DisconnectClient(params["id"])
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// Closes every connection of the user on every replica, like the multiple tabs or devices
+func DisconnectUserHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := mux.Vars(r)
+		s.Hub().DisconnectUser(params["id"])
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// Sends a system announcement to every connected client
+func AnnouncementHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request AnnouncementRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+
+		if err != nil || strings.TrimSpace(request.Message) == "" {
+			http.Error(w, "A message is required", http.StatusBadRequest)
+			return
+		}
+
+		s.Hub().Announce(request.Message)
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -1,14 +1,18 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/daluisgarcia/golang-rest-websockets/middleware"
 	"github.com/daluisgarcia/golang-rest-websockets/models"
 	"github.com/daluisgarcia/golang-rest-websockets/repositories"
 	"github.com/daluisgarcia/golang-rest-websockets/server"
+	"github.com/daluisgarcia/golang-rest-websockets/websockets"
 	"github.com/gorilla/mux"
 	"github.com/segmentio/ksuid"
 )
@@ -22,6 +26,132 @@ type PostResponse struct {
 	PostContent string `json:"postContent"`
 }
 
+var (
+	errPostNotFound  = errors.New("post not found")
+	errNotPostAuthor = errors.New("only the author can change the post")
+)
+
+// Topics notified about the events of a post
+func postTopics(post *models.Post) []string {
+	return []string{websockets.UserTopic(post.UserId), websockets.PostTopic(post.Id)}
+}
+
+// Creates the post and notifies it through websockets, shared by the REST and JSON-RPC handlers
+func createPost(ctx context.Context, s server.Server, userId string, postContent string) (*models.Post, error) {
+	id, err := ksuid.NewRandom()
+
+	if err != nil {
+		return nil, err
+	}
+
+	post := &models.Post{
+		Id:          id.String(),
+		UserId:      userId,
+		PostContent: postContent,
+	}
+
+	if err = repositories.InsertPost(ctx, post); err != nil {
+		return nil, err
+	}
+
+	// Build a message to be sent to the websocket
+	var postWebSocketMessage = models.WebSocketMessage{
+		Type:    models.PostCreatedMessageType,
+		Payload: post,
+	}
+
+	// Notifies through websockets that a new post has been created
+	s.Hub().PublishToTopics(postTopics(post), postWebSocketMessage)
+
+	return post, nil
+}
+
+// Updates the post of the user and notifies it through websockets
+func updatePost(ctx context.Context, s server.Server, postId string, userId string, postContent string) (*models.Post, error) {
+	post, err := repositories.FindPostById(ctx, postId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if post == nil {
+		return nil, errPostNotFound
+	}
+
+	post.PostContent = postContent
+	post.UserId = userId // Only the author can update the post
+
+	updated, err := repositories.UpdatePost(ctx, post)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if updated == 0 {
+		return nil, errNotPostAuthor
+	}
+
+	s.Hub().PublishToTopics(postTopics(post), models.WebSocketMessage{
+		Type: models.PostUpdatedMessageType,
+		Payload: models.PostEvent{
+			Version:     models.PostEventVersion,
+			PostId:      post.Id,
+			UserId:      post.UserId,
+			PostContent: post.PostContent,
+			OccurredAt:  time.Now(),
+		},
+	})
+
+	return post, nil
+}
+
+// Deletes the post of the user and notifies it through websockets
+func deletePost(ctx context.Context, s server.Server, postId string, userId string) error {
+	post, err := repositories.FindPostById(ctx, postId)
+
+	if err != nil {
+		return err
+	}
+
+	if post == nil {
+		return errPostNotFound
+	}
+
+	deleted, err := repositories.DeletePost(ctx, post.Id, userId)
+
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return errNotPostAuthor
+	}
+
+	s.Hub().PublishToTopics(postTopics(post), models.WebSocketMessage{
+		Type: models.PostDeletedMessageType,
+		Payload: models.PostEvent{
+			Version:    models.PostEventVersion,
+			PostId:     post.Id,
+			UserId:     post.UserId,
+			OccurredAt: time.Now(),
+		},
+	})
+
+	return nil
+}
+
+// Status code of the errors returned when changing a post
+func postErrorStatus(err error) int {
+	switch err {
+	case errPostNotFound:
+		return http.StatusNotFound
+	case errNotPostAuthor:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func InsertPostHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var request PostRequest
@@ -32,55 +162,26 @@ func InsertPostHandler(s server.Server) http.HandlerFunc {
 			return
 		}
 
-		token, err := middleware.GetJwtTokenFromHeader(s, r)
+		claims, ok := middleware.ClaimsFromContext(r.Context())
 
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+		if !ok {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		if claims, ok := token.Claims.(*models.AppClaims); ok && token.Valid {
+		post, err := createPost(r.Context(), s, claims.UserId, request.PostContent)
 
-			id, err := ksuid.NewRandom()
-
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			post := &models.Post{
-				Id:          id.String(),
-				UserId:      claims.UserId,
-				PostContent: request.PostContent,
-			}
-
-			err = repositories.InsertPost(r.Context(), post)
-
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-			// Build a message to be sent to the websocket
-			var postWebSocketMessage = models.WebSocketMessage{
-				Type:    "Post Created",
-				Payload: post,
-			}
-
-			// Notifies through websockets that a new post has been created
-			s.Hub().Broadcast(postWebSocketMessage, nil)
-
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusCreated)
-			json.NewEncoder(w).Encode(PostResponse{
-				Id:          post.Id,
-				PostContent: post.PostContent,
-			})
-		} else {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(PostResponse{
+			Id:          post.Id,
+			PostContent: post.PostContent,
+		})
 	}
 }
 
@@ -107,134 +208,91 @@ func GetPostHandler(s server.Server) http.HandlerFunc {
 
 func UpdatePostHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token, err := middleware.GetJwtTokenFromHeader(s, r)
+		claims, ok := middleware.ClaimsFromContext(r.Context())
 
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+		if !ok {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		if _, ok := token.Claims.(*models.AppClaims); ok && token.Valid {
-			params := mux.Vars(r)
-			var request PostRequest
-			err := json.NewDecoder(r.Body).Decode(&request)
-
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-
-			post, err := repositories.FindPostById(r.Context(), params["id"])
-
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-			if post == nil {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-
-			post.PostContent = request.PostContent
+		params := mux.Vars(r)
+		var request PostRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
 
-			err = repositories.UpdatePost(r.Context(), post)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		post, err := updatePost(r.Context(), s, params["id"], claims.UserId, request.PostContent)
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(PostResponse{
-				Id:          post.Id,
-				PostContent: post.PostContent,
-			})
-		} else {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		if err != nil {
+			w.WriteHeader(postErrorStatus(err))
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(PostResponse{
+			Id:          post.Id,
+			PostContent: post.PostContent,
+		})
 	}
 }
 
 func DeletePostHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token, err := middleware.GetJwtTokenFromHeader(s, r)
+		claims, ok := middleware.ClaimsFromContext(r.Context())
 
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+		if !ok {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		if claims, ok := token.Claims.(*models.AppClaims); ok && token.Valid {
-			params := mux.Vars(r)
-			post, err := repositories.FindPostById(r.Context(), params["id"])
-
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-
-			if post == nil {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-
-			err = repositories.DeletePost(r.Context(), post.Id, claims.UserId)
-
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		params := mux.Vars(r)
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusNoContent)
-		} else {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		if err := deletePost(r.Context(), s, params["id"], claims.UserId); err != nil {
+			w.WriteHeader(postErrorStatus(err))
 			return
 		}
 
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
 func ListPostsHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token, err := middleware.GetJwtTokenFromHeader(s, r)
+		claims, ok := middleware.ClaimsFromContext(r.Context())
 
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+		if !ok {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		if claims, ok := token.Claims.(*models.AppClaims); ok && token.Valid {
-			pageStr := r.URL.Query().Get("page")
-
-			var page = uint64(0)
+		pageStr := r.URL.Query().Get("page")
 
-			if pageStr != "" {
-				page, err = strconv.ParseUint(pageStr, 10, 64)
+		var page = uint64(0)
+		var err error
 
-				if err != nil {
-					w.WriteHeader(http.StatusBadRequest)
-					return
-				}
-			}
-
-			posts, err := repositories.ListPosts(r.Context(), page, claims.UserId)
+		if pageStr != "" {
+			page, err = strconv.ParseUint(pageStr, 10, 64)
 
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
+		}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(posts)
-		} else {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		posts, err := repositories.ListPosts(r.Context(), page, claims.UserId)
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(posts)
 	}
 }
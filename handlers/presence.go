@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/daluisgarcia/golang-rest-websockets/server"
+)
+
+type PresenceResponse struct {
+	Users []string `json:"users"`
+}
+
+// Lists the users connected to any replica of the server, through a websocket or an event stream
+func PresenceHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(PresenceResponse{
+			Users: s.Hub().OnlineUsers(),
+		})
+	}
+}
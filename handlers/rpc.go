@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/repositories"
+	"github.com/daluisgarcia/golang-rest-websockets/server"
+	"github.com/daluisgarcia/golang-rest-websockets/websockets"
+)
+
+type RPCPostParams struct {
+	Id          string `json:"id"`
+	PostContent string `json:"postContent"`
+}
+
+type RPCListPostsParams struct {
+	Page uint64 `json:"page"`
+}
+
+// Registers the JSON-RPC methods available through the websocket, which mirror the REST api for the socket user
+func BindRPCMethods(s server.Server) {
+	hub := s.Hub()
+
+	// Every method checks the token of the socket first
+	handle := func(method string, handler websockets.RPCHandler) {
+		hub.HandleRPC(method, withValidToken(handler))
+	}
+
+	handle("me", func(ctx context.Context, client *websockets.Client, params json.RawMessage) (interface{}, *websockets.RPCError) {
+		user, err := repositories.FindUserById(ctx, client.UserId())
+
+		if err != nil {
+			return nil, websockets.NewRPCError(websockets.RPCInternalError, err.Error())
+		}
+
+		return user, nil
+	})
+
+	handle("posts.get", func(ctx context.Context, client *websockets.Client, params json.RawMessage) (interface{}, *websockets.RPCError) {
+		var request RPCPostParams
+
+		if err := decodeRPCParams(params, &request); err != nil || request.Id == "" {
+			return nil, websockets.NewRPCError(websockets.RPCInvalidParams, "Invalid params")
+		}
+
+		post, err := repositories.FindPostById(ctx, request.Id)
+
+		if err != nil {
+			return nil, websockets.NewRPCError(websockets.RPCInternalError, err.Error())
+		}
+
+		if post == nil {
+			return nil, websockets.NewRPCError(websockets.RPCNotFound, errPostNotFound.Error())
+		}
+
+		return post, nil
+	})
+
+	handle("posts.list", func(ctx context.Context, client *websockets.Client, params json.RawMessage) (interface{}, *websockets.RPCError) {
+		var request RPCListPostsParams
+
+		if err := decodeRPCParams(params, &request); err != nil {
+			return nil, websockets.NewRPCError(websockets.RPCInvalidParams, "Invalid params")
+		}
+
+		posts, err := repositories.ListPosts(ctx, request.Page, client.UserId())
+
+		if err != nil {
+			return nil, websockets.NewRPCError(websockets.RPCInternalError, err.Error())
+		}
+
+		return posts, nil
+	})
+
+	handle("posts.create", func(ctx context.Context, client *websockets.Client, params json.RawMessage) (interface{}, *websockets.RPCError) {
+		var request RPCPostParams
+
+		if err := decodeRPCParams(params, &request); err != nil {
+			return nil, websockets.NewRPCError(websockets.RPCInvalidParams, "Invalid params")
+		}
+
+		post, err := createPost(ctx, s, client.UserId(), request.PostContent)
+
+		if err != nil {
+			return nil, postRPCError(err)
+		}
+
+		return PostResponse{
+			Id:          post.Id,
+			PostContent: post.PostContent,
+		}, nil
+	})
+
+	handle("posts.update", func(ctx context.Context, client *websockets.Client, params json.RawMessage) (interface{}, *websockets.RPCError) {
+		var request RPCPostParams
+
+		if err := decodeRPCParams(params, &request); err != nil || request.Id == "" {
+			return nil, websockets.NewRPCError(websockets.RPCInvalidParams, "Invalid params")
+		}
+
+		post, err := updatePost(ctx, s, request.Id, client.UserId(), request.PostContent)
+
+		if err != nil {
+			return nil, postRPCError(err)
+		}
+
+		return PostResponse{
+			Id:          post.Id,
+			PostContent: post.PostContent,
+		}, nil
+	})
+
+	handle("posts.delete", func(ctx context.Context, client *websockets.Client, params json.RawMessage) (interface{}, *websockets.RPCError) {
+		var request RPCPostParams
+
+		if err := decodeRPCParams(params, &request); err != nil || request.Id == "" {
+			return nil, websockets.NewRPCError(websockets.RPCInvalidParams, "Invalid params")
+		}
+
+		if err := deletePost(ctx, s, request.Id, client.UserId()); err != nil {
+			return nil, postRPCError(err)
+		}
+
+		return nil, nil
+	})
+}
+
+// Runs the method only while the token of the socket is valid, closing the socket once it expires or is revoked
+func withValidToken(handler websockets.RPCHandler) websockets.RPCHandler {
+	return func(ctx context.Context, client *websockets.Client, params json.RawMessage) (interface{}, *websockets.RPCError) {
+		claims := client.Claims()
+
+		if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+			client.Disconnect("Token expired")
+			return nil, websockets.NewRPCError(websockets.RPCUnauthorized, "Token expired")
+		}
+
+		revoked, err := repositories.IsTokenRevoked(ctx, claims)
+
+		if err != nil {
+			return nil, websockets.NewRPCError(websockets.RPCInternalError, err.Error())
+		}
+
+		if revoked {
+			client.Disconnect("Token revoked")
+			return nil, websockets.NewRPCError(websockets.RPCUnauthorized, "Token revoked")
+		}
+
+		return handler(ctx, client, params)
+	}
+}
+
+// Params are optional, so a method without them gets the zero value
+func decodeRPCParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(params, v)
+}
+
+// JSON-RPC error of the errors returned when changing a post
+func postRPCError(err error) *websockets.RPCError {
+	switch err {
+	case errPostNotFound:
+		return websockets.NewRPCError(websockets.RPCNotFound, err.Error())
+	case errNotPostAuthor:
+		return websockets.NewRPCError(websockets.RPCForbidden, err.Error())
+	default:
+		return websockets.NewRPCError(websockets.RPCInternalError, err.Error())
+	}
+}
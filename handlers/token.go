@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/middleware"
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+	"github.com/daluisgarcia/golang-rest-websockets/repositories"
+	"github.com/daluisgarcia/golang-rest-websockets/server"
+	"github.com/daluisgarcia/golang-rest-websockets/signing"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/segmentio/ksuid"
+)
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Signs a short-lived access token for the user
+func signAccessToken(ctx context.Context, s server.Server, userId string) (string, error) {
+	id, err := ksuid.NewRandom()
+
+	if err != nil {
+		return "", err
+	}
+
+	// Tells the token apart from the ones revoked by logging out of all the sessions, even within the same second
+	generation, err := repositories.UserTokenGeneration(ctx, userId)
+
+	if err != nil {
+		return "", err
+	}
+
+	claims := models.AppClaims{
+		UserId:     userId,
+		Generation: generation,
+		StandardClaims: jwt.StandardClaims{
+			Id:        id.String(), // Allows to revoke the token alone
+			Issuer:    s.Config().JWTIssuer,
+			Audience:  s.Config().JWTAudience,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(s.Config().AccessTokenTTL).Unix(),
+		},
+	}
+
+	return s.Keys().Sign(claims)
+}
+
+// Only the hash of the refresh tokens is stored
+func hashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Creates a refresh token of the family, starting a new family when it is empty. Returns the token
+// sent to the client and the record to store, which only has its hash
+func newRefreshToken(s server.Server, userId string, familyId string) (string, *models.RefreshToken, error) {
+	secret := make([]byte, 32)
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	id, err := ksuid.NewRandom()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if familyId == "" {
+		familyId = id.String()
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(secret)
+
+	return token, &models.RefreshToken{
+		Id:        id.String(),
+		FamilyId:  familyId,
+		UserId:    userId,
+		TokenHash: hashRefreshToken(token),
+		ExpiresAt: time.Now().UTC().Add(s.Config().RefreshTokenTTL), // Stored in a column without time zone
+	}, nil
+}
+
+// Issues an access token and the refresh token of a new family
+func issueTokens(ctx context.Context, s server.Server, userId string) (*LoginResponse, error) {
+	accessToken, err := signAccessToken(ctx, s, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, record, err := newRefreshToken(s, userId, "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := repositories.InsertRefreshToken(ctx, record); err != nil {
+		return nil, err
+	}
+
+	return tokensResponse(s, accessToken, refreshToken), nil
+}
+
+func tokensResponse(s server.Server, accessToken string, refreshToken string) *LoginResponse {
+	return &LoginResponse{
+		Token:        accessToken,
+		ExpiresIn:    int64(s.Config().AccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+	}
+}
+
+// Exchanges a refresh token for a new access token and a new refresh token, the used one stops working
+func RefreshTokenHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request RefreshTokenRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+
+		if err != nil || request.RefreshToken == "" {
+			http.Error(w, "A refresh token is required", http.StatusBadRequest)
+			return
+		}
+
+		refreshToken, err := repositories.FindRefreshTokenByHash(r.Context(), hashRefreshToken(request.RefreshToken))
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if refreshToken == nil || time.Now().After(refreshToken.ExpiresAt) {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+
+		if refreshToken.UsedAt != nil || refreshToken.RevokedAt != nil {
+			revokeReusedFamily(w, r, refreshToken)
+			return
+		}
+
+		// Both tokens are created before the used one is exchanged, so a failure leaves it usable for a retry
+		accessToken, err := signAccessToken(r.Context(), s, refreshToken.UserId)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		nextToken, next, err := newRefreshToken(s, refreshToken.UserId, refreshToken.FamilyId)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rotated, err := repositories.RotateRefreshToken(r.Context(), refreshToken.Id, next)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !rotated {
+			// Exchanged or revoked by a concurrent request since it was read
+			revokeReusedFamily(w, r, refreshToken)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(tokensResponse(s, accessToken, nextToken))
+	}
+}
+
+// A refresh token presented after it was exchanged or revoked means someone else holds a copy of it, so every
+// token of the login is revoked. Even when it is the legitimate client retrying, since it can not be told apart
+func revokeReusedFamily(w http.ResponseWriter, r *http.Request, refreshToken *models.RefreshToken) {
+	log.Println("Refresh token reused, revoking the family", refreshToken.FamilyId, "of user", refreshToken.UserId)
+
+	if err := repositories.RevokeRefreshTokenFamily(r.Context(), refreshToken.FamilyId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refreshToken"` // Optional, revoked along with the access token
+}
+
+// Revokes the access token of the request, closing the websockets opened with it, and when sent, the refresh
+// token of the same session
+func LogoutHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request LogoutRequest
+
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		claims, ok := middleware.ClaimsFromContext(r.Context())
+
+		if !ok {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		if claims.Id == "" {
+			http.Error(w, "The token can not be revoked alone, log out of all the sessions instead", http.StatusBadRequest)
+			return
+		}
+
+		if err := repositories.RevokeToken(r.Context(), claims); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		s.Hub().DisconnectToken(claims.Id)
+
+		if request.RefreshToken != "" {
+			refreshToken, err := repositories.FindRefreshTokenByHash(r.Context(), hashRefreshToken(request.RefreshToken))
+
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			// The refresh tokens of other users are ignored, nobody can log them out
+			if refreshToken != nil && refreshToken.UserId == claims.UserId {
+				if err := repositories.RevokeRefreshTokenFamily(r.Context(), refreshToken.FamilyId); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Revokes every access and refresh token of the user and closes their websocket connections
+func LogoutAllHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := middleware.ClaimsFromContext(r.Context())
+
+		if !ok {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		if err := repositories.RevokeUserTokens(r.Context(), claims.UserId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := repositories.RevokeUserRefreshTokens(r.Context(), claims.UserId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Closed on every replica through the backplane, so the connections of this one alone are not worth counting
+		s.Hub().DisconnectRevokedUser(claims.UserId)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Publishes the public keys that verify the access tokens, so other services can verify them
+func JWKSHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(signing.JWKSMaxAge.Seconds())))
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(s.Keys().JWKS())
+	}
+}
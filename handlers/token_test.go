@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/middleware"
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+	"github.com/daluisgarcia/golang-rest-websockets/repositories"
+	"github.com/daluisgarcia/golang-rest-websockets/server"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/segmentio/ksuid"
+)
+
+// Repository keeping the tokens in memory, the other methods are not called by the token handlers
+type fakeRepository struct {
+	repositories.Repository
+	refreshTokens map[string]*models.RefreshToken // By hash
+	generations   map[string]int64
+	revoked       map[string]bool // Access token ids
+	lostRace      bool            // Another request exchanges the token between reading and rotating it
+	mutex         *sync.Mutex
+}
+
+func (repo *fakeRepository) InsertRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.refreshTokens[token.TokenHash] = token
+	return nil
+}
+
+func (repo *fakeRepository) FindRefreshTokenByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	token, ok := repo.refreshTokens[tokenHash]
+
+	if !ok {
+		return nil, nil
+	}
+
+	read := *token // Like a row read from the database, later updates do not change it
+	return &read, nil
+}
+
+func (repo *fakeRepository) RotateRefreshToken(ctx context.Context, usedId string, next *models.RefreshToken) (bool, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	used := repo.findById(usedId)
+	now := time.Now()
+
+	if repo.lostRace {
+		used.UsedAt = &now
+	}
+
+	if used.UsedAt != nil || used.RevokedAt != nil {
+		return false, nil
+	}
+
+	used.UsedAt = &now
+	used.ReplacedBy = &next.Id
+	repo.refreshTokens[next.TokenHash] = next
+	return true, nil
+}
+
+func (repo *fakeRepository) RevokeRefreshTokenFamily(ctx context.Context, familyId string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	now := time.Now()
+	for _, token := range repo.refreshTokens {
+		if token.FamilyId == familyId && token.RevokedAt == nil {
+			token.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+func (repo *fakeRepository) RevokeUserRefreshTokens(ctx context.Context, userId string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	now := time.Now()
+	for _, token := range repo.refreshTokens {
+		if token.UserId == userId && token.RevokedAt == nil {
+			token.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+func (repo *fakeRepository) InsertRevokedToken(ctx context.Context, tokenId string, userId string, expiresAt time.Time) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.revoked[tokenId] = true
+	return nil
+}
+
+func (repo *fakeRepository) IsTokenIdRevoked(ctx context.Context, tokenId string) (bool, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	return repo.revoked[tokenId], nil
+}
+
+func (repo *fakeRepository) IncrementUserTokenGeneration(ctx context.Context, userId string) (int64, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.generations[userId]++
+	return repo.generations[userId], nil
+}
+
+func (repo *fakeRepository) FindUserTokenGeneration(ctx context.Context, userId string) (int64, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	return repo.generations[userId], nil
+}
+
+// Must be called with the mutex locked
+func (repo *fakeRepository) findById(id string) *models.RefreshToken {
+	for _, token := range repo.refreshTokens {
+		if token.Id == id {
+			return token
+		}
+	}
+
+	return nil
+}
+
+func (repo *fakeRepository) refreshToken(token string) *models.RefreshToken {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	return repo.refreshTokens[hashRefreshToken(token)]
+}
+
+func newTestServer(t *testing.T) (server.Server, *fakeRepository) {
+	t.Helper()
+
+	s, err := server.NewServer(context.Background(), &server.Config{
+		Port:        "0",
+		DatabaseUrl: "unused",
+		JWTSecret:   "test-secret",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &fakeRepository{
+		refreshTokens: make(map[string]*models.RefreshToken),
+		generations:   make(map[string]int64),
+		revoked:       make(map[string]bool),
+		mutex:         &sync.Mutex{},
+	}
+	repositories.SetRepository(repo)
+	return s, repo
+}
+
+// Logs in a new user, unique among the tests since the revocations are cached by the package
+func login(t *testing.T, s server.Server) (string, *LoginResponse) {
+	t.Helper()
+
+	userId := ksuid.New().String()
+	tokens, err := issueTokens(context.Background(), s, userId)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return userId, tokens
+}
+
+// Sends the refresh token and returns the response status and the tokens, when issued
+func refresh(t *testing.T, s server.Server, refreshToken string) (int, *LoginResponse) {
+	t.Helper()
+
+	body, _ := json.Marshal(RefreshTokenRequest{RefreshToken: refreshToken})
+	w := httptest.NewRecorder()
+	RefreshTokenHandler(s)(w, httptest.NewRequest(http.MethodPost, "/refresh", bytes.NewReader(body)))
+
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+
+	var tokens LoginResponse
+
+	if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Code, &tokens
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	s, repo := newTestServer(t)
+	userId, first := login(t, s)
+
+	status, second := refresh(t, s, first.RefreshToken)
+
+	if status != http.StatusOK {
+		t.Fatalf("got status %d, expected %d", status, http.StatusOK)
+	}
+
+	if second.Token == "" || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("got tokens %+v, expected a new pair", second)
+	}
+
+	used, next := repo.refreshToken(first.RefreshToken), repo.refreshToken(second.RefreshToken)
+
+	if used.UsedAt == nil || used.ReplacedBy == nil || *used.ReplacedBy != next.Id {
+		t.Fatalf("the used token %+v was not marked as exchanged for %s", used, next.Id)
+	}
+
+	if next.FamilyId != used.FamilyId || next.UserId != userId {
+		t.Fatalf("the new token %+v left the family %s of the user %s", next, used.FamilyId, userId)
+	}
+
+	if status, _ := refresh(t, s, second.RefreshToken); status != http.StatusOK {
+		t.Fatalf("could not refresh with the new token, got status %d", status)
+	}
+}
+
+func TestRefreshTokenRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  func(t *testing.T, s server.Server, repo *fakeRepository, tokens *LoginResponse) string // Returns the token sent
+		status int
+		revoke bool // The whole family is revoked
+	}{
+		{
+			name:   "missing token",
+			token:  func(t *testing.T, s server.Server, repo *fakeRepository, tokens *LoginResponse) string { return "" },
+			status: http.StatusBadRequest,
+		},
+		{
+			name: "unknown token",
+			token: func(t *testing.T, s server.Server, repo *fakeRepository, tokens *LoginResponse) string {
+				return "unknown"
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "expired token",
+			token: func(t *testing.T, s server.Server, repo *fakeRepository, tokens *LoginResponse) string {
+				repo.refreshToken(tokens.RefreshToken).ExpiresAt = time.Now().Add(-time.Minute)
+				return tokens.RefreshToken
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "exchanged token",
+			token: func(t *testing.T, s server.Server, repo *fakeRepository, tokens *LoginResponse) string {
+				refresh(t, s, tokens.RefreshToken)
+				return tokens.RefreshToken
+			},
+			status: http.StatusUnauthorized,
+			revoke: true,
+		},
+		{
+			name: "revoked token",
+			token: func(t *testing.T, s server.Server, repo *fakeRepository, tokens *LoginResponse) string {
+				now := time.Now()
+				repo.refreshToken(tokens.RefreshToken).RevokedAt = &now
+				return tokens.RefreshToken
+			},
+			status: http.StatusUnauthorized,
+			revoke: true,
+		},
+		{
+			name: "exchanged by a concurrent request",
+			token: func(t *testing.T, s server.Server, repo *fakeRepository, tokens *LoginResponse) string {
+				repo.lostRace = true
+				return tokens.RefreshToken
+			},
+			status: http.StatusUnauthorized,
+			revoke: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, repo := newTestServer(t)
+			_, tokens := login(t, s)
+			family := repo.refreshToken(tokens.RefreshToken).FamilyId
+
+			// Another token of the same family, which must keep working unless the family is revoked
+			sibling, record, err := newRefreshToken(s, "user", family)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			repo.InsertRefreshToken(context.Background(), record)
+
+			if status, _ := refresh(t, s, test.token(t, s, repo, tokens)); status != test.status {
+				t.Fatalf("got status %d, expected %d", status, test.status)
+			}
+
+			repo.lostRace = false
+			revoked := repo.refreshToken(sibling).RevokedAt != nil
+
+			if revoked != test.revoke {
+				t.Fatalf("family revoked: %v, expected %v", revoked, test.revoke)
+			}
+
+			if status, _ := refresh(t, s, sibling); (status == http.StatusOK) == test.revoke {
+				t.Fatalf("got status %d with another token of the family", status)
+			}
+		})
+	}
+}
+
+// Verifies the access token and returns its claims, like CheckAuthMiddleware
+func accessClaims(t *testing.T, s server.Server, token string) *models.AppClaims {
+	t.Helper()
+
+	claims := &models.AppClaims{}
+
+	if _, err := jwt.ParseWithClaims(token, claims, s.Keys().Keyfunc); err != nil {
+		t.Fatal(err)
+	}
+
+	return claims
+}
+
+func isRevoked(t *testing.T, claims *models.AppClaims) bool {
+	t.Helper()
+
+	revoked, err := repositories.IsTokenRevoked(context.Background(), claims)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return revoked
+}
+
+// Sends the request authenticated with the claims
+func serveAuthenticated(handler http.HandlerFunc, claims *models.AppClaims, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
+	w := httptest.NewRecorder()
+	handler(w, r.WithContext(middleware.WithClaims(r.Context(), claims)))
+	return w
+}
+
+func TestLogout(t *testing.T) {
+	tests := []struct {
+		name         string
+		sendRefresh  bool // Sends the refresh token of the session
+		otherUser    bool // Sends the refresh token of another user instead
+		noTokenId    bool // The access token was issued before the tokens had ids
+		status       int
+		revokeFamily bool
+		revokeAccess bool
+	}{
+		{name: "access token alone", status: http.StatusNoContent, revokeAccess: true},
+		{name: "with the refresh token", sendRefresh: true, status: http.StatusNoContent, revokeAccess: true, revokeFamily: true},
+		{name: "with the refresh token of another user", sendRefresh: true, otherUser: true, status: http.StatusNoContent, revokeAccess: true},
+		{name: "token without id", sendRefresh: true, noTokenId: true, status: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, repo := newTestServer(t)
+			_, session := login(t, s)
+			_, other := login(t, s)
+			claims := accessClaims(t, s, session.Token)
+
+			refreshToken := session.RefreshToken
+			if test.otherUser {
+				refreshToken = other.RefreshToken
+			}
+
+			if test.noTokenId {
+				claims.Id = ""
+			}
+
+			var body interface{}
+			if test.sendRefresh {
+				body = LogoutRequest{RefreshToken: refreshToken}
+			}
+
+			w := serveAuthenticated(LogoutHandler(s), claims, body)
+
+			if w.Code != test.status {
+				t.Fatalf("got status %d, expected %d", w.Code, test.status)
+			}
+
+			if revoked := !test.noTokenId && isRevoked(t, claims); revoked != test.revokeAccess {
+				t.Fatalf("access token revoked: %v, expected %v", revoked, test.revokeAccess)
+			}
+
+			if revoked := repo.refreshToken(refreshToken).RevokedAt != nil; revoked != test.revokeFamily {
+				t.Fatalf("refresh token revoked: %v, expected %v", revoked, test.revokeFamily)
+			}
+
+			// The other sessions of the user are left alone
+			if isRevoked(t, accessClaims(t, s, other.Token)) {
+				t.Fatal("revoked the access token of another session")
+			}
+		})
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	s, repo := newTestServer(t)
+	userId, first := login(t, s)
+
+	second, err := issueTokens(context.Background(), s, userId)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherUser := login(t, s)
+
+	w := serveAuthenticated(LogoutAllHandler(s), accessClaims(t, s, first.Token), nil)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, expected %d", w.Code, http.StatusNoContent)
+	}
+
+	for _, session := range []*LoginResponse{first, second} {
+		if !isRevoked(t, accessClaims(t, s, session.Token)) {
+			t.Fatal("an access token of the user was not revoked")
+		}
+
+		if repo.refreshToken(session.RefreshToken).RevokedAt == nil {
+			t.Fatal("a refresh token of the user was not revoked")
+		}
+	}
+
+	if isRevoked(t, accessClaims(t, s, otherUser.Token)) || repo.refreshToken(otherUser.RefreshToken).RevokedAt != nil {
+		t.Fatal("revoked the tokens of another user")
+	}
+
+	// Issued within the same second as the revoked ones, told apart by the generation
+	next, err := issueTokens(context.Background(), s, userId)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isRevoked(t, accessClaims(t, s, next.Token)) {
+		t.Fatal("revoked an access token issued after logging out")
+	}
+}
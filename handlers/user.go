@@ -3,13 +3,11 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
-	"time"
 
 	"github.com/daluisgarcia/golang-rest-websockets/middleware"
 	"github.com/daluisgarcia/golang-rest-websockets/models"
 	"github.com/daluisgarcia/golang-rest-websockets/repositories"
 	"github.com/daluisgarcia/golang-rest-websockets/server"
-	"github.com/golang-jwt/jwt/v4"
 	"github.com/segmentio/ksuid"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -25,7 +23,9 @@ type SignUpResponse struct {
 }
 
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	ExpiresIn    int64  `json:"expiresIn"` // Seconds until the token expires
+	RefreshToken string `json:"refreshToken"`
 }
 
 func SignUpHandler(s server.Server) http.HandlerFunc {
@@ -106,15 +106,8 @@ func LoginHandler(s server.Server) http.HandlerFunc {
 			return
 		}
 
-		claims := models.AppClaims{
-			UserId: user.Id,
-			StandardClaims: jwt.StandardClaims{
-				ExpiresAt: time.Now().Add(2 * time.Hour * 24).Unix(),
-			},
-		}
-
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString([]byte(s.Config().JWTSecret))
+		// Every login starts a new family of refresh tokens
+		response, err := issueTokens(r.Context(), s, user.Id)
 
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -124,35 +117,28 @@ func LoginHandler(s server.Server) http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 
-		json.NewEncoder(w).Encode(LoginResponse{
-			Token: tokenString,
-		})
+		json.NewEncoder(w).Encode(response)
 	}
 }
 
 func MeHandler(s server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token, err := middleware.GetJwtTokenFromHeader(s, r)
+		claims, ok := middleware.ClaimsFromContext(r.Context())
 
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+		if !ok {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		if claims, ok := token.Claims.(*models.AppClaims); ok && token.Valid {
-			user, err := repositories.FindUserById(r.Context(), claims.UserId)
-
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		user, err := repositories.FindUserById(r.Context(), claims.UserId)
 
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			json.NewEncoder(w).Encode(user)
-		} else {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(user)
 	}
 }
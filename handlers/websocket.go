@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/daluisgarcia/golang-rest-websockets/middleware"
+	"github.com/daluisgarcia/golang-rest-websockets/server"
+)
+
+func WebSocketHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := middleware.AuthenticateWebSocketRequest(s, r)
+
+		if err != nil {
+			middleware.WriteAuthError(w, err)
+			return
+		}
+
+		s.Hub().HandleWebSocket(w, r, claims)
+	}
+}
+
+func EventStreamHandler(s server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := middleware.AuthenticateEventStreamRequest(s, r)
+
+		if err != nil {
+			middleware.WriteAuthError(w, err)
+			return
+		}
+
+		s.Hub().HandleEventStream(w, r, claims)
+	}
+}
@@ -5,31 +5,111 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/daluisgarcia/golang-rest-websockets/handlers"
 	"github.com/daluisgarcia/golang-rest-websockets/middleware"
 	"github.com/daluisgarcia/golang-rest-websockets/server"
+	"github.com/daluisgarcia/golang-rest-websockets/websockets"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
 func BindRoutes(s server.Server, r *mux.Router) {
-	// Free of authentication routes
-	r.HandleFunc("/", handlers.HomeHandler(s)).Methods("GET")
-	r.HandleFunc("/signup", handlers.SignUpHandler(s)).Methods(http.MethodPost)
-	r.HandleFunc("/login", handlers.LoginHandler(s)).Methods(http.MethodPost)
-	r.HandleFunc("/posts/{id}", handlers.GetPostHandler(s)).Methods(http.MethodGet)
-	r.HandleFunc("/posts", handlers.ListPostsHandler(s)).Methods(http.MethodGet)
-	r.HandleFunc("/ws", s.Hub().HandleWebSocket)
+	// Every route declares who can call it
+	route := func(router *mux.Router, path string, access middleware.Access, handler http.Handler) *mux.Route {
+		return router.Handle(path, middleware.Require(s, access, handler))
+	}
+
+	route(r, "/", middleware.Public, handlers.HomeHandler(s)).Methods("GET")
+	route(r, "/signup", middleware.Public, handlers.SignUpHandler(s)).Methods(http.MethodPost)
+	route(r, "/login", middleware.Public, handlers.LoginHandler(s)).Methods(http.MethodPost)
+	route(r, "/token/refresh", middleware.Public, handlers.RefreshTokenHandler(s)).Methods(http.MethodPost)
+	route(r, "/.well-known/jwks.json", middleware.Public, handlers.JWKSHandler(s)).Methods(http.MethodGet)
+	route(r, "/posts/{id}", middleware.Public, handlers.GetPostHandler(s)).Methods(http.MethodGet)
+	route(r, "/posts", middleware.Authenticated, handlers.ListPostsHandler(s)).Methods(http.MethodGet) // Lists the posts of the user
+
+	// Authenticate by themselves, since browsers can also send the token as a subprotocol or a query param
+	route(r, "/ws", middleware.Public, handlers.WebSocketHandler(s))
+	route(r, "/events", middleware.Public, handlers.EventStreamHandler(s)).Methods(http.MethodGet) // Server-Sent Events fallback of the websocket
 
 	api := r.PathPrefix("/api/v1").Subrouter() // Defining a subrouter for the API
 
-	api.Use(middleware.CheckAuthMiddleware(s)) // Applies a middleware to all routes of the api
+	route(api, "/me", middleware.Authenticated, handlers.MeHandler(s)).Methods(http.MethodGet)
+	route(api, "/logout", middleware.Authenticated, handlers.LogoutHandler(s)).Methods(http.MethodPost)
+	route(api, "/logout/all", middleware.Authenticated, handlers.LogoutAllHandler(s)).Methods(http.MethodPost)
+	route(api, "/presence", middleware.Authenticated, handlers.PresenceHandler(s)).Methods(http.MethodGet)
+	route(api, "/posts", middleware.Authenticated, handlers.InsertPostHandler(s)).Methods(http.MethodPost)
+	route(api, "/posts/{id}", middleware.Authenticated, handlers.UpdatePostHandler(s)).Methods(http.MethodPut)
+	route(api, "/posts/{id}", middleware.Authenticated, handlers.DeletePostHandler(s)).Methods(http.MethodDelete)
+
+	route(api, "/admin/connections", middleware.Admin, handlers.ListConnectionsHandler(s)).Methods(http.MethodGet)
+	route(api, "/admin/connections/{id}", middleware.Admin, handlers.DisconnectClientHandler(s)).Methods(http.MethodDelete)
+	route(api, "/admin/users/{id}/connections", middleware.Admin, handlers.DisconnectUserHandler(s)).Methods(http.MethodDelete)
+	route(api, "/admin/announcements", middleware.Admin, handlers.AnnouncementHandler(s)).Methods(http.MethodPost)
+
+	handlers.BindRPCMethods(s) // Same operations through the websocket
+}
+
+// Reads a duration like "30s" from the environment, unset values fall back to zero. Stops the server when
+// the value is invalid, like a number missing its unit, instead of silently using the default
+func getDurationEnv(key string) time.Duration {
+	if os.Getenv(key) == "" {
+		return 0
+	}
+
+	value, err := time.ParseDuration(os.Getenv(key))
+
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+
+	return value
+}
+
+// Reads an integer from the environment, unset values fall back to zero and invalid ones stop the server
+func getIntEnv(key string) int {
+	if os.Getenv(key) == "" {
+		return 0
+	}
+
+	value, err := strconv.Atoi(os.Getenv(key))
+
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+
+	return value
+}
+
+// Reads a number like "0.5" from the environment, unset values fall back to zero and invalid ones stop the server
+func getFloatEnv(key string) float64 {
+	if os.Getenv(key) == "" {
+		return 0
+	}
+
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
 
-	api.HandleFunc("/me", handlers.MeHandler(s)).Methods(http.MethodGet)
-	api.HandleFunc("/posts", handlers.InsertPostHandler(s)).Methods(http.MethodPost)
-	api.HandleFunc("/posts/{id}", handlers.UpdatePostHandler(s)).Methods(http.MethodPut)
-	api.HandleFunc("/posts/{id}", handlers.DeletePostHandler(s)).Methods(http.MethodDelete)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+
+	return value
+}
+
+// Reads a comma separated list like "a,b" from the environment
+func getListEnv(key string) []string {
+	values := make([]string, 0)
+
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
 }
 
 func main() {
@@ -42,11 +122,49 @@ func main() {
 	PORT := os.Getenv("PORT")
 	JWT_SECRET := os.Getenv("JWT_SECRET")
 	DATABASE_URL := os.Getenv("DATABASE_URL")
+	BACKPLANE := os.Getenv("BACKPLANE")
 
 	s, err := server.NewServer(context.Background(), &server.Config{
-		Port:        PORT,
-		JWTSecret:   JWT_SECRET,
-		DatabaseUrl: DATABASE_URL,
+		Port:                PORT,
+		JWTSecret:           JWT_SECRET,
+		JWTAlgorithm:        os.Getenv("JWT_ALGORITHM"),
+		JWTKeyRotation:      getDurationEnv("JWT_KEY_ROTATION"),
+		JWTKeyEncryptionKey: os.Getenv("JWT_KEY_ENCRYPTION_KEY"),
+		JWTIssuer:           os.Getenv("JWT_ISSUER"),
+		JWTAudience:         os.Getenv("JWT_AUDIENCE"),
+		DatabaseUrl:         DATABASE_URL,
+		Backplane:           BACKPLANE,
+		ShutdownTimeout:     getDurationEnv("SHUTDOWN_TIMEOUT"),
+		AdminUserIds:        getListEnv("ADMIN_USER_IDS"),
+		AccessTokenTTL:      getDurationEnv("ACCESS_TOKEN_TTL"),
+		RefreshTokenTTL:     getDurationEnv("REFRESH_TOKEN_TTL"),
+		WebSocket: websockets.HubConfig{
+			WriteWait:  getDurationEnv("WS_WRITE_WAIT"),
+			PongWait:   getDurationEnv("WS_PONG_WAIT"),
+			PingPeriod: getDurationEnv("WS_PING_PERIOD"),
+
+			OutboundBufferSize: getIntEnv("WS_OUTBOUND_BUFFER_SIZE"),
+			SlowConsumerPolicy: websockets.SlowConsumerPolicy(os.Getenv("WS_SLOW_CONSUMER_POLICY")),
+			ReplayBufferSize:   getIntEnv("WS_REPLAY_BUFFER_SIZE"),
+
+			PresenceGracePeriod: getDurationEnv("WS_PRESENCE_GRACE_PERIOD"),
+			PresenceHeartbeat:   getDurationEnv("WS_PRESENCE_HEARTBEAT"),
+
+			AllowedOrigins:    getListEnv("WS_ALLOWED_ORIGINS"),
+			ReadBufferSize:    getIntEnv("WS_READ_BUFFER_SIZE"),
+			WriteBufferSize:   getIntEnv("WS_WRITE_BUFFER_SIZE"),
+			MaxMessageSize:    int64(getIntEnv("WS_MAX_MESSAGE_SIZE")),
+			EnableCompression: os.Getenv("WS_ENABLE_COMPRESSION") == "true",
+
+			MaxConnections:        getIntEnv("WS_MAX_CONNECTIONS"),
+			MaxConnectionsPerUser: getIntEnv("WS_MAX_CONNECTIONS_PER_USER"),
+			InboundRateLimit:      getFloatEnv("WS_INBOUND_RATE_LIMIT"),
+			InboundBurst:          getIntEnv("WS_INBOUND_BURST"),
+			MaxTopicsPerClient:    getIntEnv("WS_MAX_TOPICS_PER_CLIENT"),
+
+			AckTimeout:    getDurationEnv("WS_ACK_TIMEOUT"),
+			MaxAckRetries: getIntEnv("WS_MAX_ACK_RETRIES"),
+		},
 	})
 
 	if err != nil {
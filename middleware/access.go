@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/daluisgarcia/golang-rest-websockets/server"
+)
+
+// Who can call a route, declared for every route when binding it
+type Access string
+
+const (
+	Public        Access = "public"        // Anyone, no token is checked
+	Authenticated Access = "authenticated" // Requires a valid Bearer token
+	Admin         Access = "admin"         // Requires a valid Bearer token of an administrator
+)
+
+// Wraps the handler with the checks required by the access
+func Require(s server.Server, access Access, handler http.Handler) http.Handler {
+	switch access {
+	case Public:
+		return handler
+	case Authenticated:
+		return CheckAuthMiddleware(s)(handler)
+	case Admin:
+		return CheckAuthMiddleware(s)(AdminOnlyMiddleware(s)(handler))
+	default:
+		// A typo must not leave a route open
+		panic("unknown route access " + string(access))
+	}
+}
@@ -1,45 +1,265 @@
 package middleware
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/daluisgarcia/golang-rest-websockets/models"
+	"github.com/daluisgarcia/golang-rest-websockets/repositories"
 	"github.com/daluisgarcia/golang-rest-websockets/server"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/websocket"
 )
 
-var NO_AUTH_NEEDED = []string{"login", "signup"}
+// Subprotocol used by browsers to send the token, since they can not set headers on websocket requests
+const WEBSOCKET_TOKEN_PROTOCOL = "access_token"
 
-func shouldCheckAuth(path string) bool {
-	for _, p := range NO_AUTH_NEEDED {
-		if strings.Contains(path, p) {
+// Realm sent in the WWW-Authenticate challenges
+const authRealm = "golang-rest-websockets"
+
+// Error codes of RFC 6750
+const (
+	invalidRequest    = "invalid_request"
+	invalidToken      = "invalid_token"
+	insufficientScope = "insufficient_scope"
+)
+
+var (
+	ErrMissingToken = errors.New("missing access token")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+// Error of a request that could not be authenticated, replied as described by RFC 6750
+type AuthError struct {
+	Status int
+	Code   string // Empty when the request sent no token at all
+	Err    error
+}
+
+func (e *AuthError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// Replies with the error, challenging the client to send a Bearer token when it is an AuthError
+func WriteAuthError(w http.ResponseWriter, err error) {
+	var authErr *AuthError
+
+	if !errors.As(err, &authErr) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	challenge := fmt.Sprintf("Bearer realm=%q", authRealm)
+
+	if authErr.Code != "" {
+		challenge += fmt.Sprintf(", error=%q, error_description=%q", authErr.Code, challengeDescription(authErr.Err.Error()))
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, authErr.Error(), authErr.Status)
+}
+
+// Removes the characters RFC 6750 does not allow in the error description, like the quotes
+func challengeDescription(description string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return -1
+		}
+		return r
+	}, description)
+}
+
+// Verifies the signature, algorithm, expiry, issuer and audience of the token and returns its claims
+func parseJwtToken(s server.Server, tokenString string) (*models.AppClaims, error) {
+	claims := &models.AppClaims{}
+
+	// Only the configured algorithm is accepted, whatever the token header says
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{s.Keys().Algorithm()}))
+	token, err := parser.ParseWithClaims(tokenString, claims, s.Keys().Keyfunc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid || claims.UserId == "" {
+		return nil, ErrInvalidToken
+	}
+
+	// The parser only checks the expiry when the token has one, so tokens without it are rejected here
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("token is expired or has no expiry")
+	}
+
+	if !claims.VerifyIssuer(s.Config().JWTIssuer, true) {
+		return nil, errors.New("token issued by someone else")
+	}
+
+	if !claims.VerifyAudience(s.Config().JWTAudience, true) {
+		return nil, errors.New("token issued for someone else")
+	}
+
+	return claims, nil
+}
+
+// Verifies the token and checks it was not revoked, like by a logout
+func authenticate(s server.Server, r *http.Request, tokenString string) (*models.AppClaims, error) {
+	if tokenString == "" {
+		return nil, &AuthError{Status: http.StatusUnauthorized, Err: ErrMissingToken}
+	}
+
+	claims, err := parseJwtToken(s, tokenString)
+
+	if err != nil {
+		return nil, &AuthError{Status: http.StatusUnauthorized, Code: invalidToken, Err: err}
+	}
+
+	revoked, err := repositories.IsTokenRevoked(r.Context(), claims)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if revoked {
+		return nil, &AuthError{Status: http.StatusUnauthorized, Code: invalidToken, Err: ErrTokenRevoked}
+	}
+
+	return claims, nil
+}
+
+// Characters of the b64token syntax of RFC 6750, besides letters and digits
+const bearerTokenSymbols = "-._~+/"
+
+// Extracts the token of an "Authorization: Bearer <token>" header, empty when the header is not sent
+func getBearerToken(r *http.Request) (string, error) {
+	values := r.Header.Values("Authorization")
+
+	if len(values) == 0 {
+		return "", nil
+	}
+
+	if len(values) > 1 {
+		return "", &AuthError{Status: http.StatusBadRequest, Code: invalidRequest, Err: errors.New("multiple Authorization headers")}
+	}
+
+	scheme, token, _ := strings.Cut(strings.TrimSpace(values[0]), " ")
+
+	// Other schemes, like Basic, are answered with a bare challenge, as if no token was sent
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", &AuthError{Status: http.StatusUnauthorized, Err: errors.New("the Authorization scheme must be Bearer")}
+	}
+
+	token = strings.TrimSpace(token)
+
+	if !isBearerToken(token) {
+		return "", &AuthError{Status: http.StatusBadRequest, Code: invalidRequest, Err: errors.New("malformed Bearer token")}
+	}
+
+	return token, nil
+}
+
+func isBearerToken(token string) bool {
+	token = strings.TrimRight(token, "=") // Padding is only allowed at the end
+
+	if token == "" {
+		return false
+	}
+
+	for _, r := range token {
+		isAlphanumeric := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+
+		if !isAlphanumeric && !strings.ContainsRune(bearerTokenSymbols, r) {
 			return false
 		}
 	}
+
 	return true
 }
 
-func GetJwtTokenFromHeader(s server.Server, r *http.Request) (*jwt.Token, error) {
-	tokenString := strings.TrimSpace(r.Header.Get("Authorization"))
+// Looks for the token in the Authorization header, then in the Sec-WebSocket-Protocol header
+// as "access_token, <token>" and finally in the token query param
+func AuthenticateWebSocketRequest(s server.Server, r *http.Request) (*models.AppClaims, error) {
+	tokenString, err := getBearerToken(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tokenString != "" {
+		return authenticate(s, r, tokenString)
+	}
+
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == WEBSOCKET_TOKEN_PROTOCOL && i+1 < len(protocols) {
+			return authenticate(s, r, protocols[i+1])
+		}
+	}
+
+	return authenticate(s, r, r.URL.Query().Get("token"))
+}
+
+// Looks for the token in the Authorization header and then in the token query param,
+// since the browsers EventSource can not set headers
+func AuthenticateEventStreamRequest(s server.Server, r *http.Request) (*models.AppClaims, error) {
+	tokenString, err := getBearerToken(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tokenString != "" {
+		return authenticate(s, r, tokenString)
+	}
 
-	return jwt.ParseWithClaims(tokenString, &models.AppClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(s.Config().JWTSecret), nil
-	})
+	return authenticate(s, r, r.URL.Query().Get("token"))
 }
 
+// Authenticates the request once with its Bearer token and puts the claims in the context, where the
+// handlers read them with ClaimsFromContext
 func CheckAuthMiddleware(s server.Server) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !shouldCheckAuth(r.URL.Path) {
-				next.ServeHTTP(w, r)
+			tokenString, err := getBearerToken(r)
+
+			if err != nil {
+				WriteAuthError(w, err)
 				return
 			}
 
-			_, err := GetJwtTokenFromHeader(s, r)
+			claims, err := authenticate(s, r, tokenString)
 
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
+				WriteAuthError(w, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+		})
+	}
+}
+
+// Only lets through the users listed as administrators in the server config.
+// Must run after CheckAuthMiddleware
+func AdminOnlyMiddleware(s server.Server) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := ClaimsFromContext(r.Context())
+
+			if !ok {
+				WriteAuthError(w, &AuthError{Status: http.StatusUnauthorized, Err: ErrMissingToken})
+				return
+			}
+
+			if !s.Config().IsAdmin(claims.UserId) {
+				WriteAuthError(w, &AuthError{Status: http.StatusForbidden, Code: insufficientScope, Err: errors.New("admin access required")})
 				return
 			}
 
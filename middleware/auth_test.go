@@ -0,0 +1,324 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+	"github.com/daluisgarcia/golang-rest-websockets/repositories"
+	"github.com/daluisgarcia/golang-rest-websockets/server"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/segmentio/ksuid"
+)
+
+// Repository with the revocations alone, the other methods are not called by the middleware
+type fakeRepository struct {
+	repositories.Repository
+	generations map[string]int64
+	revoked     map[string]bool
+}
+
+func (repo *fakeRepository) FindUserTokenGeneration(ctx context.Context, userId string) (int64, error) {
+	return repo.generations[userId], nil
+}
+
+func (repo *fakeRepository) IsTokenIdRevoked(ctx context.Context, tokenId string) (bool, error) {
+	return repo.revoked[tokenId], nil
+}
+
+func newTestServer(t *testing.T) (server.Server, *fakeRepository) {
+	t.Helper()
+
+	s, err := server.NewServer(context.Background(), &server.Config{
+		Port:         "0",
+		DatabaseUrl:  "unused",
+		JWTSecret:    "test-secret",
+		AdminUserIds: []string{"admin"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &fakeRepository{generations: make(map[string]int64), revoked: make(map[string]bool)}
+	repositories.SetRepository(repo)
+	return s, repo
+}
+
+// Claims of a valid token, with ids unique among the tests since the revocations are cached by the package
+func newTestClaims(s server.Server, userId string) *models.AppClaims {
+	return &models.AppClaims{
+		UserId: userId + "-" + ksuid.New().String(),
+		StandardClaims: jwt.StandardClaims{
+			Id:        ksuid.New().String(),
+			Issuer:    s.Config().JWTIssuer,
+			Audience:  s.Config().JWTAudience,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		},
+	}
+}
+
+func TestGetBearerToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		token   string
+		status  int    // Zero when no error is expected
+		code    string // Error code of the challenge
+	}{
+		{name: "no header"},
+		{name: "bearer token", headers: []string{"Bearer abc.def-ghi_jkl"}, token: "abc.def-ghi_jkl"},
+		{name: "case insensitive scheme", headers: []string{"bearer abc"}, token: "abc"},
+		{name: "surrounding spaces", headers: []string{"  Bearer   abc  "}, token: "abc"},
+		{name: "padding at the end", headers: []string{"Bearer abc=="}, token: "abc=="},
+		{name: "other scheme", headers: []string{"Basic dXNlcjpwYXNz"}, status: http.StatusUnauthorized},
+		{name: "scheme alone", headers: []string{"Bearer"}, status: http.StatusBadRequest, code: invalidRequest},
+		{name: "padding in the middle", headers: []string{"Bearer ab=c"}, status: http.StatusBadRequest, code: invalidRequest},
+		{name: "space in the token", headers: []string{"Bearer abc def"}, status: http.StatusBadRequest, code: invalidRequest},
+		{name: "several headers", headers: []string{"Bearer abc", "Bearer def"}, status: http.StatusBadRequest, code: invalidRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, header := range test.headers {
+				r.Header.Add("Authorization", header)
+			}
+
+			token, err := getBearerToken(r)
+
+			if test.status == 0 {
+				if err != nil || token != test.token {
+					t.Fatalf("got %q, %v, expected %q", token, err, test.token)
+				}
+				return
+			}
+
+			var authErr *AuthError
+
+			if !errors.As(err, &authErr) {
+				t.Fatalf("got %q, %v, expected an AuthError", token, err)
+			}
+
+			if authErr.Status != test.status || authErr.Code != test.code {
+				t.Fatalf("got %d %q, expected %d %q", authErr.Status, authErr.Code, test.status, test.code)
+			}
+		})
+	}
+}
+
+func TestWriteAuthError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		status    int
+		challenge string // Empty when no challenge is expected
+	}{
+		{
+			name:      "missing token",
+			err:       &AuthError{Status: http.StatusUnauthorized, Err: ErrMissingToken},
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="golang-rest-websockets"`,
+		},
+		{
+			name:      "invalid token",
+			err:       &AuthError{Status: http.StatusUnauthorized, Code: invalidToken, Err: ErrTokenRevoked},
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="golang-rest-websockets", error="invalid_token", error_description="token revoked"`,
+		},
+		{
+			name:      "description with quotes",
+			err:       &AuthError{Status: http.StatusUnauthorized, Code: invalidToken, Err: errors.New(`bad "kid" header`)},
+			status:    http.StatusUnauthorized,
+			challenge: `Bearer realm="golang-rest-websockets", error="invalid_token", error_description="bad kid header"`,
+		},
+		{
+			name:      "insufficient scope",
+			err:       &AuthError{Status: http.StatusForbidden, Code: insufficientScope, Err: errors.New("admin access required")},
+			status:    http.StatusForbidden,
+			challenge: `Bearer realm="golang-rest-websockets", error="insufficient_scope", error_description="admin access required"`,
+		},
+		{
+			name:   "other error",
+			err:    errors.New("database is down"),
+			status: http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			WriteAuthError(w, test.err)
+
+			if w.Code != test.status {
+				t.Fatalf("got status %d, expected %d", w.Code, test.status)
+			}
+
+			if got := w.Header().Get("WWW-Authenticate"); got != test.challenge {
+				t.Fatalf("got challenge %q, expected %q", got, test.challenge)
+			}
+		})
+	}
+}
+
+func TestCheckAuthMiddleware(t *testing.T) {
+	s, repo := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		token  func(claims *models.AppClaims) string // Empty sends no token
+		status int
+		code   string
+	}{
+		{
+			name:   "valid token",
+			token:  func(claims *models.AppClaims) string { return sign(t, s, claims) },
+			status: http.StatusOK,
+		},
+		{
+			name:   "missing token",
+			token:  func(claims *models.AppClaims) string { return "" },
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "revoked token",
+			token: func(claims *models.AppClaims) string {
+				repo.revoked[claims.Id] = true
+				return sign(t, s, claims)
+			},
+			status: http.StatusUnauthorized,
+			code:   invalidToken,
+		},
+		{
+			name: "older generation",
+			token: func(claims *models.AppClaims) string {
+				repo.generations[claims.UserId] = 1
+				return sign(t, s, claims)
+			},
+			status: http.StatusUnauthorized,
+			code:   invalidToken,
+		},
+		{
+			name: "expired token",
+			token: func(claims *models.AppClaims) string {
+				claims.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+				return sign(t, s, claims)
+			},
+			status: http.StatusUnauthorized,
+			code:   invalidToken,
+		},
+		{
+			name: "other audience",
+			token: func(claims *models.AppClaims) string {
+				claims.Audience = "other-service"
+				return sign(t, s, claims)
+			},
+			status: http.StatusUnauthorized,
+			code:   invalidToken,
+		},
+		{
+			name: "other secret",
+			token: func(claims *models.AppClaims) string {
+				token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("other-secret"))
+				return token
+			},
+			status: http.StatusUnauthorized,
+			code:   invalidToken,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := newTestClaims(s, "user")
+			var got *models.AppClaims
+
+			handler := CheckAuthMiddleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = ClaimsFromContext(r.Context())
+			}))
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, authRequest(test.token(claims)))
+
+			if w.Code != test.status {
+				t.Fatalf("got status %d, expected %d", w.Code, test.status)
+			}
+
+			if test.status != http.StatusOK {
+				if got != nil {
+					t.Fatal("the handler ran without authentication")
+				}
+
+				challenge := w.Header().Get("WWW-Authenticate")
+
+				if strings.Contains(challenge, "error=") != (test.code != "") || !strings.Contains(challenge, test.code) {
+					t.Fatalf("got challenge %q, expected the code %q", challenge, test.code)
+				}
+				return
+			}
+
+			if got == nil || got.UserId != claims.UserId || got.Id != claims.Id {
+				t.Fatalf("got claims %+v in the context, expected %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestAdminOnlyMiddleware(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		claims *models.AppClaims // Nil when CheckAuthMiddleware did not run
+		status int
+	}{
+		{name: "administrator", claims: &models.AppClaims{UserId: "admin"}, status: http.StatusOK},
+		{name: "other user", claims: &models.AppClaims{UserId: "user"}, status: http.StatusForbidden},
+		{name: "no claims", status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := AdminOnlyMiddleware(s)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.claims != nil {
+				r = r.WithContext(WithClaims(r.Context(), test.claims))
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("got status %d, expected %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func sign(t *testing.T, s server.Server, claims *models.AppClaims) string {
+	t.Helper()
+
+	token, err := s.Keys().Sign(claims)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func authRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return r
+}
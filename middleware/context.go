@@ -0,0 +1,23 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+)
+
+// Unexported, so no other package can overwrite the values set here
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// Returns a copy of the context carrying the verified claims of the request
+func WithClaims(ctx context.Context, claims *models.AppClaims) context.Context {
+	return context.WithValue(ctx, claimsContextKey, claims)
+}
+
+// Claims verified by CheckAuthMiddleware, not found on the routes it does not protect
+func ClaimsFromContext(ctx context.Context) (*models.AppClaims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*models.AppClaims)
+	return claims, ok && claims != nil
+}
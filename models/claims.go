@@ -3,6 +3,7 @@ package models
 import "github.com/golang-jwt/jwt/v4"
 
 type AppClaims struct {
-	UserId string `json:"userId"`
+	UserId     string `json:"userId"`
+	Generation int64  `json:"gen,omitempty"` // The tokens of older generations of the user are revoked
 	jwt.StandardClaims
 }
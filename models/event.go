@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// Version of the post events payload, bumped only on breaking changes so clients can rely on the fields
+const PostEventVersion = 1
+
+// Payload of the Post Updated and Post Deleted messages
+type PostEvent struct {
+	Version     int       `json:"version"`
+	PostId      string    `json:"postId"`
+	UserId      string    `json:"userId"`
+	PostContent string    `json:"postContent,omitempty"` // Not sent when the post is deleted
+	OccurredAt  time.Time `json:"occurredAt"`
+}
@@ -1,6 +1,41 @@
 package models
 
+import "encoding/json"
+
+const (
+	PostCreatedMessageType  = "Post Created"
+	PostUpdatedMessageType  = "Post Updated"
+	PostDeletedMessageType  = "Post Deleted"
+	ErrorMessageType        = "Error"
+	SubscribeMessageType    = "Subscribe"
+	UnsubscribeMessageType  = "Unsubscribe"
+	SubscribedMessageType   = "Subscribed"
+	UnsubscribedMessageType = "Unsubscribed"
+	ConnectedMessageType    = "Connected"
+	ResumeMessageType       = "Resume"
+	ResyncMessageType       = "Resync Required"
+	UserOnlineMessageType   = "User Online"
+	UserOfflineMessageType  = "User Offline"
+	AckMessageType          = "Ack"
+	AnnouncementMessageType = "System Announcement"
+)
+
 type WebSocketMessage struct {
 	Type    string      `json:"type"`
 	Payload interface{} `json:"payload"`
+	Seq     uint64      `json:"seq,omitempty"` // Set by the hub on the events, replies to a client are not sequenced
+
+	Id         string `json:"id,omitempty"`         // Set by the hub when the message requires an ack
+	RequireAck bool   `json:"requireAck,omitempty"` // Resent until the client replies with an Ack carrying the id
+}
+
+// Decodes the payload of a message received from a client into the given struct
+func (m *WebSocketMessage) DecodePayload(v interface{}) error {
+	data, err := json.Marshal(m.Payload)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
 }
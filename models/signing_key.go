@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// Private key used to sign the access tokens, shared by every replica of the server
+type SigningKey struct {
+	Id         string    `json:"id"` // Sent as the kid header of the tokens
+	Algorithm  string    `json:"algorithm"`
+	PrivateKey []byte    `json:"-"` // PKCS #8 DER encoded and encrypted with AES-GCM, prefixed by the nonce
+	CreatedAt  time.Time `json:"createdAt"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Long-lived token exchanged for new access tokens. Every refresh replaces it by a new one of the
+// same family, so a token used twice means it was stolen and the whole family gets revoked
+type RefreshToken struct {
+	Id         string     `json:"id"`
+	FamilyId   string     `json:"familyId"` // Shared by the tokens issued from the same login
+	UserId     string     `json:"userId"`
+	TokenHash  string     `json:"-"` // Only the hash is stored, so a leaked database does not leak the tokens
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UsedAt     *time.Time `json:"usedAt"`     // Set once it is exchanged for a new one
+	ReplacedBy *string    `json:"replacedBy"` // Id of the token it was exchanged for
+	RevokedAt  *time.Time `json:"revokedAt"`
+}
@@ -2,6 +2,7 @@ package repositories
 
 import (
 	"context"
+	"time"
 
 	"github.com/daluisgarcia/golang-rest-websockets/models"
 )
@@ -13,9 +14,21 @@ type Repository interface {
 	FindUserByEmail(ctx context.Context, email string) (*models.User, error)
 	InsertPost(ctx context.Context, post *models.Post) error
 	FindPostById(ctx context.Context, id string) (*models.Post, error)
-	UpdatePost(ctx context.Context, post *models.Post) error
-	DeletePost(ctx context.Context, id string, userId string) error
+	UpdatePost(ctx context.Context, post *models.Post) (int64, error)
+	DeletePost(ctx context.Context, id string, userId string) (int64, error)
 	ListPosts(ctx context.Context, page uint64, userId string) ([]*models.Post, error)
+	InsertRefreshToken(ctx context.Context, token *models.RefreshToken) error
+	FindRefreshTokenByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, usedId string, next *models.RefreshToken) (bool, error)
+	RevokeRefreshTokenFamily(ctx context.Context, familyId string) error
+	RevokeUserRefreshTokens(ctx context.Context, userId string) error
+	InsertRevokedToken(ctx context.Context, tokenId string, userId string, expiresAt time.Time) error
+	IsTokenIdRevoked(ctx context.Context, tokenId string) (bool, error)
+	DeleteRevokedTokensExpiredBefore(ctx context.Context, before time.Time) (int64, error)
+	IncrementUserTokenGeneration(ctx context.Context, userId string) (int64, error)
+	FindUserTokenGeneration(ctx context.Context, userId string) (int64, error)
+	InsertSigningKey(ctx context.Context, key *models.SigningKey) error
+	ListSigningKeys(ctx context.Context, algorithm string, limit int) ([]*models.SigningKey, error)
 }
 
 var implementation Repository
@@ -48,14 +61,50 @@ func FindPostById(ctx context.Context, id string) (*models.Post, error) {
 	return implementation.FindPostById(ctx, id)
 }
 
-func UpdatePost(ctx context.Context, post *models.Post) error {
+// Returns the number of updated posts, which is zero when the user is not the author
+func UpdatePost(ctx context.Context, post *models.Post) (int64, error) {
 	return implementation.UpdatePost(ctx, post)
 }
 
-func DeletePost(ctx context.Context, id string, userId string) error {
+// Returns the number of deleted posts, which is zero when the user is not the author
+func DeletePost(ctx context.Context, id string, userId string) (int64, error) {
 	return implementation.DeletePost(ctx, id, userId)
 }
 
 func ListPosts(ctx context.Context, page uint64, userId string) ([]*models.Post, error) {
 	return implementation.ListPosts(ctx, page, userId)
 }
+
+func InsertRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	return implementation.InsertRefreshToken(ctx, token)
+}
+
+// Returns nil when no token has the given hash
+func FindRefreshTokenByHash(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	return implementation.FindRefreshTokenByHash(ctx, tokenHash)
+}
+
+// Marks the token as exchanged for the next one and stores the next one, all or nothing. Returns false when the
+// token was revoked or already exchanged
+func RotateRefreshToken(ctx context.Context, usedId string, next *models.RefreshToken) (bool, error) {
+	return implementation.RotateRefreshToken(ctx, usedId, next)
+}
+
+// Revokes every token issued from the same login
+func RevokeRefreshTokenFamily(ctx context.Context, familyId string) error {
+	return implementation.RevokeRefreshTokenFamily(ctx, familyId)
+}
+
+// Revokes every refresh token of the user, like when logging out of all the sessions
+func RevokeUserRefreshTokens(ctx context.Context, userId string) error {
+	return implementation.RevokeUserRefreshTokens(ctx, userId)
+}
+
+func InsertSigningKey(ctx context.Context, key *models.SigningKey) error {
+	return implementation.InsertSigningKey(ctx, key)
+}
+
+// Returns the last keys created for the algorithm, newest first
+func ListSigningKeys(ctx context.Context, algorithm string, limit int) ([]*models.SigningKey, error) {
+	return implementation.ListSigningKeys(ctx, algorithm, limit)
+}
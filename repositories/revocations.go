@@ -0,0 +1,193 @@
+package repositories
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+)
+
+// Time a token is trusted as not revoked before asking the database again. Revocations made by
+// other replicas take up to this long to be noticed
+const revocationCacheTTL = 30 * time.Second
+
+// How often the revoked tokens that already expired are deleted
+const revokedTokensPurgeInterval = time.Hour
+
+// Results of the revocation lookups, so the database is not queried on every request
+type revocationCache struct {
+	tokens map[string]cachedRevocation // By token id
+	users  map[string]cachedGeneration // By user id
+	mutex  *sync.Mutex
+}
+
+type cachedRevocation struct {
+	revoked bool
+	until   time.Time // Revoked tokens are kept until they expire, since that never changes
+}
+
+type cachedGeneration struct {
+	generation int64 // Tokens of older generations are revoked
+	until      time.Time
+}
+
+var revocations = &revocationCache{
+	tokens: make(map[string]cachedRevocation),
+	users:  make(map[string]cachedGeneration),
+	mutex:  &sync.Mutex{},
+}
+
+// Revokes the token with the given claims, which must carry an id
+func RevokeToken(ctx context.Context, claims *models.AppClaims) error {
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+
+	if err := implementation.InsertRevokedToken(ctx, claims.Id, claims.UserId, expiresAt.UTC()); err != nil {
+		return err
+	}
+
+	revocations.mutex.Lock()
+	defer revocations.mutex.Unlock()
+	revocations.tokens[claims.Id] = cachedRevocation{revoked: true, until: expiresAt}
+	return nil
+}
+
+// Revokes every token issued to the user until now, the ones issued afterwards get the next generation
+func RevokeUserTokens(ctx context.Context, userId string) error {
+	generation, err := implementation.IncrementUserTokenGeneration(ctx, userId)
+
+	if err != nil {
+		return err
+	}
+
+	revocations.mutex.Lock()
+	defer revocations.mutex.Unlock()
+	revocations.users[userId] = cachedGeneration{generation: generation, until: time.Now().Add(revocationCacheTTL)}
+	return nil
+}
+
+// Generation of the tokens issued to the user now. Always read from the database, since a token issued
+// with a stale generation would be revoked as soon as the cache of the replicas expires
+func UserTokenGeneration(ctx context.Context, userId string) (int64, error) {
+	generation, err := implementation.FindUserTokenGeneration(ctx, userId)
+
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+
+	revocations.mutex.Lock()
+	defer revocations.mutex.Unlock()
+	revocations.users[userId] = cachedGeneration{generation: generation, until: now.Add(revocationCacheTTL)}
+	revocations.prune(now)
+	return generation, nil
+}
+
+// Tells if the token was revoked, by itself or along with every token of its user
+func IsTokenRevoked(ctx context.Context, claims *models.AppClaims) (bool, error) {
+	generation, err := userTokenGeneration(ctx, claims.UserId)
+
+	if err != nil {
+		return false, err
+	}
+
+	if claims.Generation < generation {
+		return true, nil
+	}
+
+	if claims.Id == "" {
+		return false, nil // Issued before the tokens had ids, they can only be revoked with the rest of the user
+	}
+
+	return isTokenIdRevoked(ctx, claims.Id, time.Unix(claims.ExpiresAt, 0))
+}
+
+func isTokenIdRevoked(ctx context.Context, tokenId string, expiresAt time.Time) (bool, error) {
+	now := time.Now()
+
+	revocations.mutex.Lock()
+	cached, ok := revocations.tokens[tokenId]
+	revocations.mutex.Unlock()
+
+	if ok && now.Before(cached.until) {
+		return cached.revoked, nil
+	}
+
+	revoked, err := implementation.IsTokenIdRevoked(ctx, tokenId)
+
+	if err != nil {
+		return false, err
+	}
+
+	cached = cachedRevocation{revoked: revoked, until: now.Add(revocationCacheTTL)}
+
+	if revoked {
+		cached.until = expiresAt
+	}
+
+	revocations.mutex.Lock()
+	defer revocations.mutex.Unlock()
+	revocations.tokens[tokenId] = cached
+	revocations.prune(now)
+	return revoked, nil
+}
+
+// Same as UserTokenGeneration, but trusting the cache
+func userTokenGeneration(ctx context.Context, userId string) (int64, error) {
+	revocations.mutex.Lock()
+	cached, ok := revocations.users[userId]
+	revocations.mutex.Unlock()
+
+	if ok && time.Now().Before(cached.until) {
+		return cached.generation, nil
+	}
+
+	return UserTokenGeneration(ctx, userId)
+}
+
+// Deletes the revoked tokens once they expire, since their expiry rejects them anyway.
+// Runs until the context is cancelled
+func PurgeExpiredRevokedTokens(ctx context.Context) {
+	ticker := time.NewTicker(revokedTokensPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := implementation.DeleteRevokedTokensExpiredBefore(ctx, time.Now().UTC()) // Stored without time zone
+
+			if err != nil {
+				log.Println("Could not purge the expired revoked tokens:", err)
+				continue
+			}
+
+			if deleted > 0 {
+				log.Println("Purged", deleted, "expired revoked tokens")
+			}
+		}
+	}
+}
+
+// Forgets the stale results once the cache grows, so it does not keep one entry per token ever seen.
+// Must be called with the mutex locked
+func (cache *revocationCache) prune(now time.Time) {
+	if len(cache.tokens)+len(cache.users) < 10000 {
+		return
+	}
+
+	for id, cached := range cache.tokens {
+		if now.After(cached.until) {
+			delete(cache.tokens, id)
+		}
+	}
+
+	for id, cached := range cache.users {
+		if now.After(cached.until) {
+			delete(cache.users, id)
+		}
+	}
+}
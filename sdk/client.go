@@ -0,0 +1,381 @@
+// Package sdk is a client for the websocket event stream of the server, for the services consuming the post events
+package sdk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+	"github.com/daluisgarcia/golang-rest-websockets/websockets"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+	recentEventsSize  = 1024
+	anyMessageType    = "*"
+)
+
+var (
+	ErrUnauthorized = errors.New("the token was rejected by the server")
+	ErrNotConnected = errors.New("not connected to the server")
+)
+
+// Returns the token sent when connecting, called on every connection so it can be renewed
+type TokenSource func(ctx context.Context) (string, error)
+
+// Token source of a token that never changes
+func StaticToken(token string) TokenSource {
+	return func(ctx context.Context) (string, error) {
+		return token, nil
+	}
+}
+
+type Config struct {
+	URL        string        // Websocket endpoint, like ws://localhost:5050/ws
+	Token      TokenSource   // JWT of the user the client connects as
+	Topics     []string      // Subscribed on every connection, besides the own user topic
+	MinBackoff time.Duration // Wait before the first reconnection, doubled after every failed attempt
+	MaxBackoff time.Duration
+	Dialer     *websocket.Dialer // Defaults to websocket.DefaultDialer
+	OnError    func(err error)   // Called with the errors that do not stop the client, like a lost connection
+}
+
+type Client struct {
+	config   *Config
+	handlers map[string][]Handler
+	topics   map[string]bool
+	conn     *websocket.Conn // Nil while disconnected
+	streamId string          // Position in the event stream, used to resume after reconnecting
+	lastSeq  uint64
+	recent   *recentEvents
+	mutex    *sync.Mutex // Guards the connection, the topics and the stream position
+	writes   *sync.Mutex // Gorilla connections support a single writer at a time
+}
+
+func NewClient(config Config) (*Client, error) {
+	if config.URL == "" {
+		return nil, errors.New("url is required")
+	}
+
+	if config.Token == nil {
+		return nil, errors.New("token is required")
+	}
+
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+
+	if config.Dialer == nil {
+		config.Dialer = websocket.DefaultDialer
+	}
+
+	topics := make(map[string]bool)
+	for _, topic := range config.Topics {
+		topics[topic] = true
+	}
+
+	return &Client{
+		config:   &config,
+		handlers: make(map[string][]Handler),
+		topics:   topics,
+		recent:   newRecentEvents(recentEventsSize),
+		mutex:    &sync.Mutex{},
+		writes:   &sync.Mutex{},
+	}, nil
+}
+
+// Keeps the client connected, reconnecting with backoff and resuming from the last event received,
+// until the context is cancelled or the server rejects the token
+func (c *Client) Run(ctx context.Context) error {
+	backoff := c.config.MinBackoff
+
+	for {
+		connected, err := c.connect(ctx)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err == ErrUnauthorized {
+			return err
+		}
+
+		c.reportError(err)
+
+		if connected {
+			backoff = c.config.MinBackoff // Only consecutive failures make the client wait longer
+		}
+
+		// The jitter keeps the clients from reconnecting all at once after a server restart
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		if backoff *= 2; backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+	}
+}
+
+// Subscribes to the topic now, if connected, and on every reconnection. While disconnected the subscription
+// waits for the next connection, so only the errors sending it to a connected server are returned
+func (c *Client) Subscribe(topic string) error {
+	c.mutex.Lock()
+	c.topics[topic] = true
+	c.mutex.Unlock()
+
+	return c.sendIfConnected(models.WebSocketMessage{
+		Type:    models.SubscribeMessageType,
+		Payload: websockets.SubscriptionPayload{Topic: topic},
+	})
+}
+
+func (c *Client) Unsubscribe(topic string) error {
+	c.mutex.Lock()
+	delete(c.topics, topic)
+	c.mutex.Unlock()
+
+	return c.sendIfConnected(models.WebSocketMessage{
+		Type:    models.UnsubscribeMessageType,
+		Payload: websockets.SubscriptionPayload{Topic: topic},
+	})
+}
+
+// Same as send, but not being connected is not an error, since the next connection catches up
+func (c *Client) sendIfConnected(message models.WebSocketMessage) error {
+	if err := c.send(message); err != ErrNotConnected {
+		return err
+	}
+
+	return nil
+}
+
+// Opens a connection and reads from it until it is lost, telling if the server accepted it
+func (c *Client) connect(ctx context.Context) (bool, error) {
+	token, err := c.config.Token(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+
+	conn, response, err := c.config.Dialer.DialContext(ctx, c.config.URL, header)
+
+	if err != nil {
+		if response != nil && response.StatusCode == http.StatusUnauthorized {
+			return false, ErrUnauthorized
+		}
+		return false, err
+	}
+
+	c.mutex.Lock()
+	c.conn = conn
+	c.mutex.Unlock()
+
+	stop := make(chan struct{})
+
+	defer func() {
+		close(stop)
+
+		c.mutex.Lock()
+		c.conn = nil
+		c.mutex.Unlock()
+
+		conn.Close()
+	}()
+
+	// Closes the connection when the context is cancelled, which unblocks the read below
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.writes.Lock()
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(time.Second),
+			)
+			c.writes.Unlock()
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	connected := false
+
+	for {
+		var message struct {
+			Type       string          `json:"type"`
+			Payload    json.RawMessage `json:"payload"`
+			Seq        uint64          `json:"seq"`
+			Id         string          `json:"id"`
+			RequireAck bool            `json:"requireAck"`
+		}
+
+		if err := conn.ReadJSON(&message); err != nil {
+			return connected, err
+		}
+
+		event := Event{Type: message.Type, Seq: message.Seq, Payload: message.Payload}
+
+		switch message.Type {
+		case models.ConnectedMessageType:
+			connected = true
+
+			if err := c.onConnected(event); err != nil {
+				return connected, err
+			}
+			continue
+		case models.ResyncMessageType:
+			c.onResync(event)
+		}
+
+		if message.RequireAck {
+			c.send(models.WebSocketMessage{
+				Type:    models.AckMessageType,
+				Payload: websockets.AckPayload{Id: message.Id},
+			})
+		}
+
+		if message.Seq > 0 && !c.track(message.Seq) {
+			continue // Already handled, like the messages resent while the server waits for their ack
+		}
+
+		c.dispatch(event)
+	}
+}
+
+// Subscribes to the topics and asks for the events missed while disconnected, along with the ones of the
+// topics sent since connecting
+func (c *Client) onConnected(event Event) error {
+	var position websockets.StreamPosition
+
+	if err := event.Decode(&position); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	if c.streamId == "" {
+		// First connection, the events before it are not of interest
+		c.streamId = position.StreamId
+		c.lastSeq = position.Seq
+	}
+
+	// The topics go along with the resume, so no event is missed between connecting and subscribing
+	resume := websockets.ResumePayload{
+		StreamId: c.streamId,
+		LastSeq:  c.lastSeq,
+		Topics:   make([]string, 0, len(c.topics)),
+	}
+	for topic := range c.topics {
+		resume.Topics = append(resume.Topics, topic)
+	}
+	c.mutex.Unlock()
+
+	return c.send(models.WebSocketMessage{
+		Type:    models.ResumeMessageType,
+		Payload: resume,
+	})
+}
+
+// Starts over from the current position of the stream, since the missed events are gone
+func (c *Client) onResync(event Event) {
+	var position websockets.StreamPosition
+
+	if err := event.Decode(&position); err != nil {
+		c.reportError(err)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.streamId = position.StreamId
+	c.lastSeq = position.Seq
+	c.recent = newRecentEvents(recentEventsSize)
+}
+
+// Records the sequence number of an event, telling if it was not seen before
+func (c *Client) track(seq uint64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.recent.add(seq) {
+		return false
+	}
+
+	if seq > c.lastSeq {
+		c.lastSeq = seq
+	}
+
+	return true
+}
+
+func (c *Client) send(message models.WebSocketMessage) error {
+	c.mutex.Lock()
+	conn := c.conn
+	c.mutex.Unlock()
+
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	c.writes.Lock()
+	defer c.writes.Unlock()
+
+	return conn.WriteJSON(message)
+}
+
+func (c *Client) reportError(err error) {
+	if err != nil && c.config.OnError != nil {
+		c.config.OnError(err)
+	}
+}
+
+// Sequence numbers of the last events received. The replayed and resent events arrive after newer ones,
+// so the duplicates can not be told apart by comparing with the last sequence number only
+type recentEvents struct {
+	seen  map[uint64]bool
+	order []uint64 // Oldest first
+	size  int
+}
+
+func newRecentEvents(size int) *recentEvents {
+	return &recentEvents{
+		seen:  make(map[uint64]bool),
+		order: make([]uint64, 0, size),
+		size:  size,
+	}
+}
+
+// Tells if the sequence number was not seen before
+func (r *recentEvents) add(seq uint64) bool {
+	if r.seen[seq] {
+		return false
+	}
+
+	if len(r.order) == r.size {
+		delete(r.seen, r.order[0])
+		r.order = r.order[1:]
+	}
+
+	r.seen[seq] = true
+	r.order = append(r.order, seq)
+	return true
+}
@@ -0,0 +1,87 @@
+package sdk
+
+import (
+	"encoding/json"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+	"github.com/daluisgarcia/golang-rest-websockets/websockets"
+)
+
+// Message received from the hub
+type Event struct {
+	Type    string
+	Seq     uint64 // Zero for the replies that are not part of the event stream
+	Payload json.RawMessage
+}
+
+// Decodes the payload of the event into the given struct
+func (e Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
+
+type Handler func(event Event)
+
+// Registers the handler to be called when an event of the given type arrives. Handlers run in the
+// goroutine reading the connection, one at a time, and must be registered before calling Run
+func (c *Client) Handle(messageType string, handler Handler) {
+	c.handlers[messageType] = append(c.handlers[messageType], handler)
+}
+
+// Registers a handler for every event, like the ones of a type the client does not know about
+func (c *Client) HandleAll(handler Handler) {
+	c.Handle(anyMessageType, handler)
+}
+
+func (c *Client) OnPostCreated(handler func(post models.Post)) {
+	handleTyped(c, models.PostCreatedMessageType, handler)
+}
+
+func (c *Client) OnPostUpdated(handler func(event models.PostEvent)) {
+	handleTyped(c, models.PostUpdatedMessageType, handler)
+}
+
+func (c *Client) OnPostDeleted(handler func(event models.PostEvent)) {
+	handleTyped(c, models.PostDeletedMessageType, handler)
+}
+
+func (c *Client) OnUserOnline(handler func(presence websockets.PresencePayload)) {
+	handleTyped(c, models.UserOnlineMessageType, handler)
+}
+
+func (c *Client) OnUserOffline(handler func(presence websockets.PresencePayload)) {
+	handleTyped(c, models.UserOfflineMessageType, handler)
+}
+
+func (c *Client) OnAnnouncement(handler func(announcement websockets.AnnouncementPayload)) {
+	handleTyped(c, models.AnnouncementMessageType, handler)
+}
+
+// Called when the missed events could not be replayed after reconnecting, like when the server
+// restarted, so the state kept by the caller should be reloaded from the REST API
+func (c *Client) OnResync(handler func(position websockets.StreamPosition)) {
+	handleTyped(c, models.ResyncMessageType, handler)
+}
+
+// Decodes the payload before calling the handler, reporting the payloads that do not match the type
+func handleTyped[T any](c *Client, messageType string, handler func(payload T)) {
+	c.Handle(messageType, func(event Event) {
+		var payload T
+
+		if err := event.Decode(&payload); err != nil {
+			c.reportError(err)
+			return
+		}
+
+		handler(payload)
+	})
+}
+
+func (c *Client) dispatch(event Event) {
+	for _, handler := range c.handlers[event.Type] {
+		handler(event)
+	}
+
+	for _, handler := range c.handlers[anyMessageType] {
+		handler(event)
+	}
+}
@@ -2,32 +2,76 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/daluisgarcia/golang-rest-websockets/database"
 	"github.com/daluisgarcia/golang-rest-websockets/repositories"
+	"github.com/daluisgarcia/golang-rest-websockets/signing"
 	"github.com/daluisgarcia/golang-rest-websockets/websockets"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
+// Backplanes used to propagate the websocket messages between the server replicas
+const (
+	MemoryBackplane   = "memory" // Single replica
+	PostgresBackplane = "postgres"
+)
+
+const (
+	defaultShutdownTimeout = 15 * time.Second
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+	defaultJWTIssuer       = "golang-rest-websockets"
+	defaultJWTAudience     = "golang-rest-websockets"
+)
+
 type Config struct {
-	Port        string
-	JWTSecret   string
-	DatabaseUrl string
+	Port                string
+	JWTSecret           string        // Only needed by HS256
+	JWTAlgorithm        string        // HS256, RS256 or EdDSA, defaults to HS256
+	JWTKeyRotation      time.Duration // Time between the creation of new signing keys, zero never rotates them
+	JWTKeyEncryptionKey string        // Encrypts the signing keys stored in the database, required by RS256 and EdDSA
+	JWTIssuer           string        // Set as the iss claim of the tokens and required when verifying them
+	JWTAudience         string        // Set as the aud claim of the tokens and required when verifying them
+	DatabaseUrl         string
+	Backplane           string        // Defaults to MemoryBackplane
+	ShutdownTimeout     time.Duration // Time given to the in-flight requests to finish when stopping
+	AdminUserIds        []string      // Users allowed to use the admin API
+	AccessTokenTTL      time.Duration // Lifetime of the JWTs, kept short since they can not be revoked
+	RefreshTokenTTL     time.Duration // Lifetime of the refresh tokens, every refresh issues a new one
+	WebSocket           websockets.HubConfig
+}
+
+// Tells if the user is allowed to use the admin API
+func (config *Config) IsAdmin(userId string) bool {
+	for _, adminId := range config.AdminUserIds {
+		if adminId == userId {
+			return true
+		}
+	}
+
+	return false
 }
 
 type Server interface {
 	Config() *Config
 	Hub() *websockets.Hub
+	Keys() *signing.KeySet
 }
 
 type Broker struct {
 	config *Config
 	router *mux.Router
 	hub    *websockets.Hub
+	keys   *signing.KeySet
 }
 
 func NewServer(ctx context.Context, config *Config) (*Broker, error) {
@@ -35,18 +79,53 @@ func NewServer(ctx context.Context, config *Config) (*Broker, error) {
 		return nil, fmt.Errorf("port is required")
 	}
 
-	if config.JWTSecret == "" {
-		return nil, fmt.Errorf("jwt secret is required")
-	}
-
 	if config.DatabaseUrl == "" {
 		return nil, fmt.Errorf("database url is required")
 	}
 
+	switch config.Backplane {
+	case "":
+		config.Backplane = MemoryBackplane
+	case MemoryBackplane, PostgresBackplane:
+	default:
+		return nil, fmt.Errorf("unknown backplane %s", config.Backplane)
+	}
+
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+
+	if config.AccessTokenTTL <= 0 {
+		config.AccessTokenTTL = defaultAccessTokenTTL
+	}
+
+	if config.RefreshTokenTTL <= 0 {
+		config.RefreshTokenTTL = defaultRefreshTokenTTL
+	}
+
+	if config.JWTIssuer == "" {
+		config.JWTIssuer = defaultJWTIssuer
+	}
+
+	if config.JWTAudience == "" {
+		config.JWTAudience = defaultJWTAudience
+	}
+
+	if config.JWTAlgorithm == "" {
+		config.JWTAlgorithm = signing.HS256
+	}
+
+	keys, err := signing.NewKeySet(config.JWTAlgorithm, config.JWTSecret, config.JWTKeyEncryptionKey, config.JWTKeyRotation, config.AccessTokenTTL)
+
+	if err != nil {
+		return nil, err
+	}
+
 	return &Broker{
 		config: config,
 		router: mux.NewRouter(),
-		hub:    websockets.NewHub(),
+		hub:    websockets.NewHub(config.WebSocket),
+		keys:   keys,
 	}, nil
 }
 
@@ -58,6 +137,10 @@ func (b *Broker) Hub() *websockets.Hub {
 	return b.hub
 }
 
+func (b *Broker) Keys() *signing.KeySet {
+	return b.keys
+}
+
 func (b *Broker) Start(binder func(s Server, r *mux.Router)) {
 	if b.router == nil || b.config == nil {
 		log.Fatal("Server not initialized correctly")
@@ -72,14 +155,76 @@ func (b *Broker) Start(binder func(s Server, r *mux.Router)) {
 		log.Fatal(err)
 	}
 
+	if b.config.Backplane == PostgresBackplane {
+		backplane, err := database.NewPostgresBackplane(b.config.DatabaseUrl)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := b.hub.UseBackplane(backplane); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	go b.Hub().Run()
 
 	repositories.SetRepository(repo)
 
-	log.Println("Server started on port", b.config.Port)
+	// Stops the background jobs, like the key rotation, once the server shuts down
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+
+	if err := b.keys.Start(jobsCtx); err != nil {
+		log.Fatal("Error when loading the signing keys: ", err)
+	}
+
+	go repositories.PurgeExpiredRevokedTokens(jobsCtx)
+
+	httpServer := &http.Server{
+		Addr:    ":" + b.config.Port,
+		Handler: handler,
+	}
+
+	go func() {
+		log.Println("Server started on port", b.config.Port)
+
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Error when starting the server: ", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	b.shutdown(httpServer)
+}
+
+// Stops accepting requests, drains the in-flight ones, closes the websockets and the database
+func (b *Broker) shutdown(httpServer *http.Server) {
+	log.Println("Shutting down the server")
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.config.ShutdownTimeout)
+	defer cancel()
+
+	// Websockets and event streams never finish by themselves, so the hub closes them alongside the requests
+	hubStopped := make(chan error, 1)
+	go func() {
+		hubStopped <- b.hub.Shutdown(ctx)
+	}()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Println("Error when stopping the server:", err)
+	}
+
+	if err := <-hubStopped; err != nil {
+		log.Println("Error when stopping the websocket hub:", err)
+	}
 
-	if err := http.ListenAndServe(":"+b.config.Port, handler); err != nil {
-		log.Fatal("Error when starting the server: ", err)
+	if err := repositories.Close(); err != nil {
+		log.Println("Error when closing the database:", err)
 	}
 
+	log.Println("Server stopped")
 }
@@ -0,0 +1,43 @@
+package signing
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// Encrypts the private keys before they are stored, so reading the database is not enough to forge tokens.
+// The AES-256 key is derived from the secret given in the config
+func newKeyCipher(secret string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Returns the nonce followed by the encrypted key. The key id is authenticated along with it, so a stored
+// key can not be swapped for another one
+func (ks *KeySet) seal(id string, der []byte) ([]byte, error) {
+	nonce := make([]byte, ks.cipher.NonceSize())
+
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return ks.cipher.Seal(nonce, nonce, der, []byte(id)), nil
+}
+
+func (ks *KeySet) open(id string, sealed []byte) ([]byte, error) {
+	if len(sealed) < ks.cipher.NonceSize() {
+		return nil, errors.New("encrypted key too short")
+	}
+
+	nonce, encrypted := sealed[:ks.cipher.NonceSize()], sealed[ks.cipher.NonceSize():]
+	return ks.cipher.Open(nil, nonce, encrypted, []byte(id))
+}
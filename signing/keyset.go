@@ -0,0 +1,355 @@
+// Package signing holds the keys used to sign and verify the access tokens
+package signing
+
+import (
+	"context"
+	"crypto"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+	"github.com/daluisgarcia/golang-rest-websockets/repositories"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/segmentio/ksuid"
+)
+
+// Algorithms supported to sign the access tokens
+const (
+	HS256 = "HS256" // Shared secret, only the servers holding it can verify the tokens
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+)
+
+const (
+	rsaKeyBits = 2048
+
+	// Time between the reloads of the keys, so the replicas pick the keys created by the others
+	refreshInterval = time.Minute
+
+	// Minimum time between the reloads caused by tokens signed with an unknown key
+	missingKeyReloadInterval = 5 * time.Second
+
+	// Keys loaded from the repository, more than the ones that can still verify a token
+	loadedKeys = 10
+
+	// A new key is published in the JWKS this long before it signs, so the verifiers caching the JWKS
+	// and the replicas reloading the keys know it by then
+	keyActivationDelay = JWKSMaxAge + refreshInterval
+)
+
+// Time the verifiers can cache the JWKS
+const JWKSMaxAge = 5 * time.Minute
+
+var ErrUnknownKey = errors.New("token signed with an unknown key")
+
+type key struct {
+	id        string
+	private   crypto.Signer
+	createdAt time.Time
+}
+
+type KeySet struct {
+	algorithm  string
+	method     jwt.SigningMethod
+	secret     []byte        // Only for HS256
+	cipher     cipher.AEAD   // Encrypts the stored keys, not used by HS256
+	rotation   time.Duration // Zero keeps signing with the same key
+	tokenTTL   time.Duration // Keys keep verifying for this long after a newer key replaces them
+	keys       []*key        // Newest first, the newest one activated signs
+	lastReload time.Time
+	mutex      *sync.RWMutex
+}
+
+// The encryption key protects the private keys stored in the database, only needed by RS256 and EdDSA
+func NewKeySet(algorithm string, secret string, encryptionKey string, rotation time.Duration, tokenTTL time.Duration) (*KeySet, error) {
+	if rotation > 0 && rotation < keyActivationDelay {
+		return nil, fmt.Errorf("jwt key rotation must be at least %s, the time a new key is published before signing", keyActivationDelay)
+	}
+
+	keySet := &KeySet{
+		algorithm: algorithm,
+		secret:    []byte(secret),
+		rotation:  rotation,
+		tokenTTL:  tokenTTL,
+		mutex:     &sync.RWMutex{},
+	}
+
+	switch algorithm {
+	case HS256:
+		if secret == "" {
+			return nil, fmt.Errorf("jwt secret is required for %s", algorithm)
+		}
+		keySet.method = jwt.SigningMethodHS256
+	case RS256:
+		keySet.method = jwt.SigningMethodRS256
+	case EdDSA:
+		keySet.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unknown jwt algorithm %s", algorithm)
+	}
+
+	if algorithm != HS256 {
+		if encryptionKey == "" {
+			return nil, fmt.Errorf("jwt key encryption key is required for %s", algorithm)
+		}
+
+		keyCipher, err := newKeyCipher(encryptionKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keySet.cipher = keyCipher
+	}
+
+	return keySet, nil
+}
+
+func (ks *KeySet) Algorithm() string {
+	return ks.algorithm
+}
+
+// Loads the keys, creating the first one if needed, and keeps them rotated until the context is done.
+// Must be called once the repository is set
+func (ks *KeySet) Start(ctx context.Context) error {
+	if ks.algorithm == HS256 {
+		return nil
+	}
+
+	if err := ks.refresh(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := ks.refresh(ctx); err != nil {
+					log.Println("Could not refresh the signing keys:", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Reloads the keys and creates the next one ahead of time, so it activates once the newest is due for rotation
+func (ks *KeySet) refresh(ctx context.Context) error {
+	if err := ks.reload(ctx); err != nil {
+		return err
+	}
+
+	ks.mutex.RLock()
+	rotate := len(ks.keys) == 0 || (ks.rotation > 0 && time.Since(ks.keys[0].createdAt) >= ks.rotation-keyActivationDelay)
+	ks.mutex.RUnlock()
+
+	if !rotate {
+		return nil
+	}
+
+	// Replicas rotating at once create a key each, which is fine since all of them verify
+	if err := ks.generate(ctx); err != nil {
+		return err
+	}
+
+	return ks.reload(ctx)
+}
+
+func (ks *KeySet) reload(ctx context.Context) error {
+	stored, err := repositories.ListSigningKeys(ctx, ks.algorithm, loadedKeys)
+
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*key, 0, len(stored))
+
+	for _, storedKey := range stored {
+		der, err := ks.open(storedKey.Id, storedKey.PrivateKey)
+
+		if err != nil {
+			return fmt.Errorf("could not decrypt signing key %s, check the encryption key: %w", storedKey.Id, err)
+		}
+
+		private, err := x509.ParsePKCS8PrivateKey(der)
+
+		if err != nil {
+			return fmt.Errorf("invalid signing key %s: %w", storedKey.Id, err)
+		}
+
+		signer, ok := private.(crypto.Signer)
+
+		if !ok {
+			return fmt.Errorf("invalid signing key %s", storedKey.Id)
+		}
+
+		keys = append(keys, &key{id: storedKey.Id, private: signer, createdAt: storedKey.CreatedAt})
+	}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	ks.keys = keys
+	ks.lastReload = time.Now()
+	return nil
+}
+
+func (ks *KeySet) generate(ctx context.Context) error {
+	var private crypto.Signer
+	var err error
+
+	if ks.algorithm == RS256 {
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	} else {
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+
+	if err != nil {
+		return err
+	}
+
+	id, err := ksuid.NewRandom()
+
+	if err != nil {
+		return err
+	}
+
+	sealed, err := ks.seal(id.String(), der)
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("Created the signing key", id.String())
+
+	return repositories.InsertSigningKey(ctx, &models.SigningKey{
+		Id:         id.String(),
+		Algorithm:  ks.algorithm,
+		PrivateKey: sealed,
+		CreatedAt:  time.Now().UTC(), // Stored in a column without time zone
+	})
+}
+
+// Keys that can still verify a token, the newest one first, including the ones not activated yet.
+// Must be called with the mutex locked
+func (ks *KeySet) verifying() []*key {
+	now := time.Now()
+
+	for i := 1; i < len(ks.keys); i++ {
+		// Replaced keys stop signing once the next one activates, and their last tokens expire after tokenTTL
+		if now.Sub(ks.keys[i-1].createdAt.Add(keyActivationDelay)) > ks.tokenTTL+refreshInterval {
+			return ks.keys[:i]
+		}
+	}
+
+	return ks.keys
+}
+
+// Key the tokens are signed with, the newest one published for long enough. Must be called with the mutex
+// locked and some key loaded
+func (ks *KeySet) signing() *key {
+	now := time.Now()
+
+	for _, key := range ks.keys {
+		if !now.Before(key.createdAt.Add(keyActivationDelay)) {
+			return key
+		}
+	}
+
+	// None was published for long enough, like on the first start, so the one published first signs
+	return ks.keys[len(ks.keys)-1]
+}
+
+// Signs the claims with the current key, adding its id as the kid header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.method, claims)
+
+	if ks.algorithm == HS256 {
+		return token.SignedString(ks.secret)
+	}
+
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	if len(ks.keys) == 0 {
+		return "", errors.New("no signing key loaded")
+	}
+
+	key := ks.signing()
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
+}
+
+// Returns the key to verify the token with, used as the jwt.Keyfunc when parsing tokens
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	// Checked so a token can not pick a weaker algorithm, like HS256 with the public key as secret
+	if token.Method.Alg() != ks.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+
+	if ks.algorithm == HS256 {
+		return ks.secret, nil
+	}
+
+	id, _ := token.Header["kid"].(string)
+
+	if public, ok := ks.publicKey(id); ok {
+		return public, nil
+	}
+
+	// The key may have been created by another replica since the last reload. The reload time is claimed
+	// right away, so a burst of such tokens reloads the keys once
+	ks.mutex.Lock()
+	reload := time.Since(ks.lastReload) >= missingKeyReloadInterval
+	if reload {
+		ks.lastReload = time.Now()
+	}
+	ks.mutex.Unlock()
+
+	if reload {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := ks.reload(ctx); err != nil {
+			log.Println("Could not reload the signing keys:", err)
+		}
+
+		if public, ok := ks.publicKey(id); ok {
+			return public, nil
+		}
+	}
+
+	return nil, ErrUnknownKey
+}
+
+func (ks *KeySet) publicKey(id string) (crypto.PublicKey, bool) {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	for _, key := range ks.verifying() {
+		if key.id == id {
+			return key.private.Public(), true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,344 @@
+package signing
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+	"github.com/daluisgarcia/golang-rest-websockets/repositories"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	testEncryptionKey = "test-encryption-key"
+	testTokenTTL      = 15 * time.Minute
+)
+
+// Repository keeping the signing keys in memory, the other methods are not called by the key set
+type fakeRepository struct {
+	repositories.Repository
+	keys  []*models.SigningKey
+	mutex *sync.Mutex
+}
+
+func (repo *fakeRepository) InsertSigningKey(ctx context.Context, key *models.SigningKey) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.keys = append(repo.keys, key)
+	return nil
+}
+
+func (repo *fakeRepository) ListSigningKeys(ctx context.Context, algorithm string, limit int) ([]*models.SigningKey, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	var keys []*models.SigningKey
+	for _, key := range repo.keys {
+		if key.Algorithm == algorithm {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	return keys, nil
+}
+
+func newTestKeySet(t *testing.T, rotation time.Duration) (*KeySet, *fakeRepository) {
+	t.Helper()
+
+	ks, err := NewKeySet(EdDSA, "", testEncryptionKey, rotation, testTokenTTL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &fakeRepository{mutex: &sync.Mutex{}}
+	repositories.SetRepository(repo)
+	return ks, repo
+}
+
+// Stores a key created the given time ago and returns its id
+func storeKey(t *testing.T, ks *KeySet, repo *fakeRepository, age time.Duration) string {
+	t.Helper()
+
+	if err := ks.generate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	key := repo.keys[len(repo.keys)-1]
+	key.CreatedAt = time.Now().UTC().Add(-age)
+	return key.Id
+}
+
+func TestSigningAndPublishedKeys(t *testing.T) {
+	tests := []struct {
+		name      string
+		ages      []time.Duration // Of the stored keys
+		signing   int             // Index in ages of the key that signs
+		published []int           // Indexes in ages of the keys in the JWKS, newest first
+	}{
+		{
+			name:      "first start",
+			ages:      []time.Duration{0},
+			signing:   0,
+			published: []int{0},
+		},
+		{
+			name:      "none activated yet",
+			ages:      []time.Duration{time.Minute, 3 * time.Minute},
+			signing:   1,
+			published: []int{0, 1},
+		},
+		{
+			name:      "next key pending",
+			ages:      []time.Duration{time.Minute, time.Hour},
+			signing:   1,
+			published: []int{0, 1},
+		},
+		{
+			name:      "next key activated",
+			ages:      []time.Duration{keyActivationDelay, time.Hour},
+			signing:   0,
+			published: []int{0, 1},
+		},
+		{
+			name:      "replaced key still verifying",
+			ages:      []time.Duration{keyActivationDelay + testTokenTTL, time.Hour},
+			signing:   0,
+			published: []int{0, 1},
+		},
+		{
+			name:      "replaced key retired",
+			ages:      []time.Duration{keyActivationDelay + testTokenTTL + refreshInterval + time.Minute, time.Hour},
+			signing:   0,
+			published: []int{0},
+		},
+		{
+			name:      "older keys retired",
+			ages:      []time.Duration{time.Minute, time.Hour, 2 * time.Hour, 3 * time.Hour},
+			signing:   1,
+			published: []int{0, 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ks, repo := newTestKeySet(t, 0)
+
+			ids := make([]string, len(test.ages))
+			for i, age := range test.ages {
+				ids[i] = storeKey(t, ks, repo, age)
+			}
+
+			if err := ks.reload(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			ks.mutex.RLock()
+			signing := ks.signing()
+			ks.mutex.RUnlock()
+
+			if signing.id != ids[test.signing] {
+				t.Fatalf("signing with %s, expected %s", signing.id, ids[test.signing])
+			}
+
+			jwks := ks.JWKS()
+
+			if len(jwks.Keys) != len(test.published) {
+				t.Fatalf("published %d keys, expected %d", len(jwks.Keys), len(test.published))
+			}
+
+			for i, index := range test.published {
+				jwk := jwks.Keys[i]
+
+				if jwk.KeyId != ids[index] || jwk.KeyType != "OKP" || jwk.Algorithm != EdDSA || jwk.X == "" {
+					t.Fatalf("published %+v, expected the key %s", jwk, ids[index])
+				}
+			}
+		})
+	}
+}
+
+func TestRefreshCreatesTheNextKeyAhead(t *testing.T) {
+	rotation := time.Hour
+
+	tests := []struct {
+		name   string
+		ages   []time.Duration
+		create bool
+	}{
+		{name: "no key", create: true},
+		{name: "recent key", ages: []time.Duration{time.Minute}},
+		{name: "key close to the rotation", ages: []time.Duration{rotation - keyActivationDelay - time.Minute}},
+		{name: "key due for the rotation", ages: []time.Duration{rotation - keyActivationDelay}, create: true},
+		{name: "next key already created", ages: []time.Duration{time.Minute, rotation}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ks, repo := newTestKeySet(t, rotation)
+
+			for _, age := range test.ages {
+				storeKey(t, ks, repo, age)
+			}
+
+			if err := ks.refresh(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			created := len(repo.keys) > len(test.ages)
+
+			if created != test.create {
+				t.Fatalf("created a key: %v, expected %v", created, test.create)
+			}
+
+			if len(ks.keys) != len(repo.keys) {
+				t.Fatalf("loaded %d keys, expected %d", len(ks.keys), len(repo.keys))
+			}
+		})
+	}
+}
+
+func TestSignedTokensVerify(t *testing.T) {
+	ks, _ := newTestKeySet(t, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := ks.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tokenString, err := ks.Sign(jwt.RegisteredClaims{Subject: "user"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Parse(tokenString, ks.Keyfunc)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.Header["kid"] != ks.keys[0].id {
+		t.Fatalf("signed with the kid %v, expected %s", token.Header["kid"], ks.keys[0].id)
+	}
+
+	// Signed by a key set whose keys this one does not know
+	other, _ := newTestKeySet(t, 0)
+
+	if err := other.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tokenString, err = other.Sign(jwt.RegisteredClaims{Subject: "user"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jwt.Parse(tokenString, ks.Keyfunc); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got %v, expected %v", err, ErrUnknownKey)
+	}
+
+	// HS256 with a published key as the secret
+	tokenString, err = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "user"}).SignedString([]byte(ks.JWKS().Keys[0].X))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := jwt.Parse(tokenString, ks.Keyfunc); err == nil {
+		t.Fatal("verified a token signed with another algorithm")
+	}
+}
+
+func TestStoredKeysAreEncrypted(t *testing.T) {
+	ks, repo := newTestKeySet(t, 0)
+
+	if err := ks.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := repo.keys[0]
+
+	if _, err := x509.ParsePKCS8PrivateKey(stored.PrivateKey); err == nil {
+		t.Fatal("stored the private key in plain text")
+	}
+
+	tests := []struct {
+		name          string
+		encryptionKey string
+		swapId        bool // Stores the key under another id
+	}{
+		{name: "other encryption key", encryptionKey: "other-encryption-key"},
+		{name: "other key id", encryptionKey: testEncryptionKey, swapId: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			other, err := NewKeySet(EdDSA, "", test.encryptionKey, 0, testTokenTTL)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key := *stored
+			if test.swapId {
+				key.Id = "another-key"
+			}
+
+			repositories.SetRepository(&fakeRepository{keys: []*models.SigningKey{&key}, mutex: &sync.Mutex{}})
+
+			if err := other.reload(context.Background()); err == nil || !strings.Contains(err.Error(), "could not decrypt") {
+				t.Fatalf("got %v, expected a decryption error", err)
+			}
+		})
+	}
+}
+
+func TestNewKeySet(t *testing.T) {
+	tests := []struct {
+		name          string
+		algorithm     string
+		secret        string
+		encryptionKey string
+		rotation      time.Duration
+		err           string // Empty when no error is expected
+	}{
+		{name: "HS256", algorithm: HS256, secret: "secret"},
+		{name: "HS256 without secret", algorithm: HS256, err: "jwt secret is required"},
+		{name: "RS256", algorithm: RS256, encryptionKey: testEncryptionKey, rotation: 24 * time.Hour},
+		{name: "EdDSA without rotation", algorithm: EdDSA, encryptionKey: testEncryptionKey},
+		{name: "EdDSA without encryption key", algorithm: EdDSA, err: "jwt key encryption key is required"},
+		{name: "RS256 without encryption key", algorithm: RS256, err: "jwt key encryption key is required"},
+		{name: "rotation shorter than the activation", algorithm: EdDSA, encryptionKey: testEncryptionKey, rotation: keyActivationDelay - time.Second, err: "jwt key rotation must be at least"},
+		{name: "unknown algorithm", algorithm: "none", err: "unknown jwt algorithm"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewKeySet(test.algorithm, test.secret, test.encryptionKey, test.rotation, testTokenTTL)
+
+			if test.err == "" && err != nil {
+				t.Fatalf("got %v, expected no error", err)
+			}
+
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("got %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
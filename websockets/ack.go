@@ -0,0 +1,116 @@
+package websockets
+
+import (
+	"log"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+)
+
+type AckPayload struct {
+	Id string `json:"id"`
+}
+
+// Message sent to a client and not acknowledged yet
+type pendingAck struct {
+	data     []byte
+	attempts int
+	timer    *time.Timer
+}
+
+// Queues the message and, when it requires an ack, keeps resending it until the client acknowledges it.
+// Must be called with the hub mutex locked
+func (c *Client) deliver(sequenced *sequencedMessage) {
+	data, err := sequenced.encode(c.encoding)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	c.enqueue(data)
+
+	// Event streams are one way, so their clients can not ack
+	if sequenced.ackId == "" || c.socket == nil {
+		return
+	}
+
+	c.acksMutex.Lock()
+	defer c.acksMutex.Unlock()
+
+	if _, ok := c.pendingAcks[sequenced.ackId]; ok {
+		return // Already waiting for it, like when the message is replayed
+	}
+
+	pending := &pendingAck{data: data}
+	pending.timer = time.AfterFunc(c.hub.config.AckTimeout, func() {
+		c.retry(sequenced.ackId, pending)
+	})
+
+	c.pendingAcks[sequenced.ackId] = pending
+}
+
+func (c *Client) retry(id string, pending *pendingAck) {
+	c.acksMutex.Lock()
+	defer c.acksMutex.Unlock()
+
+	if current, ok := c.pendingAcks[id]; !ok || current != pending {
+		return // Acknowledged meanwhile
+	}
+
+	if pending.attempts >= c.hub.config.MaxAckRetries {
+		delete(c.pendingAcks, id)
+		c.hub.recordAckFailure(c, id)
+		return
+	}
+
+	pending.attempts++
+	c.enqueue(pending.data)
+	pending.timer.Reset(c.hub.config.AckTimeout)
+}
+
+func (c *Client) acknowledge(id string) {
+	c.acksMutex.Lock()
+	defer c.acksMutex.Unlock()
+
+	if pending, ok := c.pendingAcks[id]; ok {
+		pending.timer.Stop()
+		delete(c.pendingAcks, id)
+	}
+}
+
+// Gives up on every message still waiting for an ack, called once the client is gone
+func (c *Client) abandonAcks() {
+	c.acksMutex.Lock()
+	defer c.acksMutex.Unlock()
+
+	for id, pending := range c.pendingAcks {
+		pending.timer.Stop()
+		delete(c.pendingAcks, id)
+		c.hub.recordAckFailure(c, id)
+	}
+}
+
+func (hub *Hub) recordAckFailure(client *Client, id string) {
+	hub.ackFailures.Add(1)
+	log.Println("Message", id, "was not acknowledged by client", client.id, "of user", client.userId)
+}
+
+// Number of messages that were never acknowledged by a client after every retry
+func (hub *Hub) AckFailures() uint64 {
+	return hub.ackFailures.Load()
+}
+
+func (hub *Hub) handleAck(client *Client, message *models.WebSocketMessage) {
+	var payload AckPayload
+
+	if err := message.DecodePayload(&payload); err != nil || payload.Id == "" {
+		client.Send(models.WebSocketMessage{
+			Type:    models.ErrorMessageType,
+			Payload: "Invalid ack",
+		})
+		return
+	}
+
+	client.acknowledge(payload.Id)
+}
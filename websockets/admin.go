@@ -0,0 +1,255 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+	"github.com/gorilla/websocket"
+	"github.com/segmentio/ksuid"
+)
+
+// Reason sent in the close frame of the clients disconnected by an administrator
+const adminDisconnectReason = "Disconnected by an administrator"
+
+// Copy of the state of a client, safe to use once the hub lock is released
+type ClientInfo struct {
+	Id            string    `json:"id"`
+	UserId        string    `json:"userId"`
+	RemoteAddress string    `json:"remoteAddress"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	Transport     string    `json:"transport"` // "websocket" or "event-stream"
+	Encoding      Encoding  `json:"encoding"`
+	Topics        []string  `json:"topics"`
+	Sent          uint64    `json:"sent"`
+	Dropped       uint64    `json:"dropped"`
+}
+
+// Clients of a node, as listed by it through the backplane
+type NodeClients struct {
+	Node        string       `json:"node"`
+	Clients     []ClientInfo `json:"clients"`
+	Dropped     uint64       `json:"dropped"`     // Across every client since the node started
+	AckFailures uint64       `json:"ackFailures"` // Messages never acknowledged since the node started
+}
+
+// Close frame of the clients disconnected through the backplane
+type disconnectRequest struct {
+	Reason string `json:"reason"`
+}
+
+type AnnouncementPayload struct {
+	Message string    `json:"message"`
+	SentAt  time.Time `json:"sentAt"`
+}
+
+// Must be called with the hub mutex locked, since it reads the topics of the client
+func (c *Client) info() ClientInfo {
+	transport := "websocket"
+
+	if c.socket == nil {
+		transport = "event-stream"
+	}
+
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	return ClientInfo{
+		Id:            c.id,
+		UserId:        c.userId,
+		RemoteAddress: c.remoteAddr,
+		ConnectedAt:   c.connectedAt,
+		Transport:     transport,
+		Encoding:      c.encoding,
+		Topics:        topics,
+		Sent:          c.sent.Load(),
+		Dropped:       c.dropped.Load(),
+	}
+}
+
+// Snapshot of the clients connected to this node only, oldest connection first
+func (hub *Hub) Clients() []ClientInfo {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	clients := make([]ClientInfo, 0, len(hub.clients))
+	for _, client := range hub.clients {
+		clients = append(clients, client.info())
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+	})
+
+	return clients
+}
+
+// Lists the clients of every node, asking them through the backplane. Returns once the nodes known from the
+// presence heartbeats answer or the context is done, along with the ids of the known nodes that did not answer.
+// A node that started less than a heartbeat ago is only listed if it answers before that
+func (hub *Hub) ClusterClients(ctx context.Context) ([]NodeClients, []string) {
+	requestId := ksuid.New().String()
+
+	hub.mutex.Lock()
+	pending := map[string]bool{hub.streamId: true}
+	for nodeId := range hub.presence {
+		pending[nodeId] = true
+	}
+
+	answers := make(chan *NodeClients, len(pending)+16) // Room for the nodes not known yet
+	hub.listings[requestId] = answers
+	hub.mutex.Unlock()
+
+	defer func() {
+		hub.mutex.Lock()
+		delete(hub.listings, requestId)
+		hub.mutex.Unlock()
+	}()
+
+	hub.publish(&Envelope{Kind: ListClientsEnvelope, Targets: []string{requestId}})
+
+	nodes := make([]NodeClients, 0, len(pending))
+
+collect:
+	for len(pending) > 0 {
+		select {
+		case answer := <-answers:
+			delete(pending, answer.Node)
+			nodes = append(nodes, *answer)
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Node < nodes[j].Node
+	})
+
+	missing := make([]string, 0, len(pending))
+	for nodeId := range pending {
+		missing = append(missing, nodeId)
+	}
+	sort.Strings(missing)
+
+	return nodes, missing
+}
+
+// Sends the clients of this node to the hub that asked for them
+func (hub *Hub) answerListing(requestId string) {
+	data, err := json.Marshal(NodeClients{
+		Node:        hub.streamId,
+		Clients:     hub.Clients(),
+		Dropped:     hub.DroppedMessages(),
+		AckFailures: hub.AckFailures(),
+	})
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	hub.publish(&Envelope{Kind: ClientsEnvelope, Targets: []string{requestId}, Message: data})
+}
+
+// Hands the clients of a node to the ClusterClients call waiting for them, the ones asked by other hubs are
+// ignored. Must be called with the hub mutex locked
+func (hub *Hub) applyListing(envelope *Envelope) {
+	answers, ok := hub.listings[envelope.Targets[0]]
+
+	if !ok {
+		return
+	}
+
+	var answer NodeClients
+
+	if err := json.Unmarshal(envelope.Message, &answer); err != nil {
+		log.Println(err)
+		return
+	}
+
+	select {
+	case answers <- &answer:
+	default: // More nodes than expected, the call already has enough to wait for
+	}
+}
+
+// Closes the connection of the client, on whichever node it is connected to
+func (hub *Hub) DisconnectClient(clientId string) {
+	hub.propagateDisconnect(DisconnectClientEnvelope, clientId, adminDisconnectReason)
+}
+
+// Closes every connection of the user, on every node
+func (hub *Hub) DisconnectUser(userId string) {
+	hub.propagateDisconnect(DisconnectUserEnvelope, userId, adminDisconnectReason)
+}
+
+// Closes every connection opened with the token on every node, once it is revoked like by a logout
+func (hub *Hub) DisconnectToken(tokenId string) {
+	hub.propagateDisconnect(DisconnectTokenEnvelope, tokenId, tokenRevokedReason)
+}
+
+// Closes every connection of the user on every node, once all their tokens are revoked
+func (hub *Hub) DisconnectRevokedUser(userId string) {
+	hub.propagateDisconnect(DisconnectUserEnvelope, userId, tokenRevokedReason)
+}
+
+func (hub *Hub) propagateDisconnect(kind string, target string, reason string) {
+	data, err := json.Marshal(disconnectRequest{Reason: reason})
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	hub.publish(&Envelope{Kind: kind, Targets: []string{target}, Message: data})
+}
+
+// Closes the clients of this node matching the disconnect envelope. Must be called with the hub mutex locked
+func (hub *Hub) applyDisconnect(envelope *Envelope) {
+	var request disconnectRequest
+
+	if err := json.Unmarshal(envelope.Message, &request); err != nil {
+		log.Println(err)
+		return
+	}
+
+	clients := make([]*Client, 0)
+
+	switch envelope.Kind {
+	case DisconnectClientEnvelope:
+		if client, ok := hub.clients[envelope.Targets[0]]; ok {
+			clients = append(clients, client)
+		}
+	case DisconnectUserEnvelope:
+		for client := range hub.users[envelope.Targets[0]] {
+			clients = append(clients, client)
+		}
+	case DisconnectTokenEnvelope:
+		for _, client := range hub.clients {
+			if client.claims.Id != "" && client.claims.Id == envelope.Targets[0] {
+				clients = append(clients, client)
+			}
+		}
+	}
+
+	for _, client := range clients {
+		hub.disconnectLocked(client, websocket.ClosePolicyViolation, request.Reason)
+	}
+}
+
+// Sends a system announcement to every client, on every node
+func (hub *Hub) Announce(message string) {
+	hub.Broadcast(models.WebSocketMessage{
+		Type: models.AnnouncementMessageType,
+		Payload: AnnouncementPayload{
+			Message: message,
+			SentAt:  time.Now(),
+		},
+	}, nil)
+}
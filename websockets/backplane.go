@@ -0,0 +1,75 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// Kinds of deliveries propagated through the backplane
+const (
+	BroadcastEnvelope = "broadcast"
+	TopicEnvelope     = "topic"
+	UserEnvelope      = "user"
+	PresenceEnvelope  = "presence" // Users connected to the node that sent it, not delivered to any client
+
+	// Close the matching clients instead of delivering a message to them
+	DisconnectClientEnvelope = "disconnect-client"
+	DisconnectUserEnvelope   = "disconnect-user"
+	DisconnectTokenEnvelope  = "disconnect-token"
+
+	// Ask every node for its clients and carry the answers back, not delivered to any client
+	ListClientsEnvelope = "list-clients"
+	ClientsEnvelope     = "clients"
+)
+
+// A message to be delivered by every hub connected to the backplane
+type Envelope struct {
+	Kind    string          `json:"kind"`
+	Targets []string        `json:"targets,omitempty"` // Topics, user id, client id, token id or request id, depending on the kind
+	Ignore  string          `json:"ignore,omitempty"`  // Id of a client that must not receive the message
+	Message json.RawMessage `json:"message"`
+}
+
+// Propagates the deliveries of a hub to the hubs of every other node, including itself
+type Backplane interface {
+	Publish(ctx context.Context, envelope *Envelope) error
+	Subscribe(handler func(envelope *Envelope)) error
+	Close() error
+}
+
+// Backplane for a single node, also allows to connect several hubs of the same process in tests
+type MemoryBackplane struct {
+	handlers []func(envelope *Envelope)
+	mutex    *sync.RWMutex
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{
+		handlers: make([]func(envelope *Envelope), 0),
+		mutex:    &sync.RWMutex{},
+	}
+}
+
+func (b *MemoryBackplane) Publish(ctx context.Context, envelope *Envelope) error {
+	b.mutex.RLock()
+	handlers := append([]func(envelope *Envelope){}, b.handlers...)
+	b.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(envelope)
+	}
+
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(handler func(envelope *Envelope)) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	return nil
+}
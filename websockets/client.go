@@ -1,37 +1,273 @@
 package websockets
 
 import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
 	"github.com/gorilla/websocket"
+	"github.com/segmentio/ksuid"
+)
+
+// Reasons sent in the close frame of the clients whose token is no longer valid
+const (
+	tokenExpiredReason = "Token expired"
+	tokenRevokedReason = "Token revoked"
 )
 
+// Reason sent in the close frame of the clients disconnected for not reading fast enough
+const slowConsumerReason = "Slow consumer"
+
 type Client struct {
-	hub      *Hub
-	id       string
-	socket   *websocket.Conn
-	outbound chan []byte
+	hub         *Hub
+	id          string
+	userId      string
+	claims      *models.AppClaims // Verified claims of the token the client connected with
+	socket      *websocket.Conn   // Nil for the Server-Sent Events clients
+	encoding    Encoding          // Format of the messages queued in outbound
+	remoteAddr  string
+	connectedAt time.Time
+	connectSeq  uint64 // Last event before the client connected, the later ones are delivered as they happen
+	outbound    chan []byte
+	topics      map[string]bool // Guarded by the hub mutex
+	done        chan struct{}   // Closed by the hub when the client is unregistered
+	ctx         context.Context // Cancelled along with done, so the work done for the client stops
+	cancel      context.CancelFunc
+	expiry      *time.Timer // Disconnects the client once its token expires, nil when it never does
+	closeCode   int         // Sent in the close frame, set by the hub before closing done
+	closeReason string
+	limiter     *rateLimiter           // Inbound messages allowed, nil when unlimited
+	pendingAcks map[string]*pendingAck // Sent messages waiting for an ack, by message id
+	acksMutex   *sync.Mutex
+	sent        atomic.Uint64 // Messages written to the connection
+	dropped     atomic.Uint64 // Messages discarded because the client fell behind
+	evicted     atomic.Bool   // Set once the client is being disconnected for falling behind
 }
 
-func NewClient(hub *Hub, socket *websocket.Conn) *Client {
+func NewClient(hub *Hub, socket *websocket.Conn, claims *models.AppClaims) (*Client, error) {
+	id, err := ksuid.NewRandom() // Remote addresses are not unique behind proxies
+
+	if err != nil {
+		return nil, err
+	}
+
+	var limiter *rateLimiter
+
+	if hub.config.InboundRateLimit > 0 {
+		limiter = newRateLimiter(hub.config.InboundRateLimit, hub.config.InboundBurst)
+	}
+
+	encoding := JSONEncoding
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if socket != nil {
+		encoding = encodingOf(socket)
+	}
+
 	return &Client{
-		hub:      hub,
-		socket:   socket,
-		outbound: make(chan []byte),
+		hub:         hub,
+		id:          id.String(),
+		userId:      claims.UserId,
+		claims:      claims,
+		socket:      socket,
+		encoding:    encoding,
+		connectedAt: time.Now(),
+		outbound:    make(chan []byte, hub.config.OutboundBufferSize),
+		topics:      make(map[string]bool),
+		done:        make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+		limiter:     limiter,
+		pendingAcks: make(map[string]*pendingAck),
+		acksMutex:   &sync.Mutex{},
+	}, nil
+}
+
+func (c *Client) Id() string {
+	return c.id
+}
+
+func (c *Client) UserId() string {
+	return c.userId
+}
+
+// Claims of the token the client connected with, which must not be modified
+func (c *Client) Claims() *models.AppClaims {
+	return c.claims
+}
+
+// Closes the connection with a policy violation close frame, like when its token is no longer valid
+func (c *Client) Disconnect(reason string) {
+	c.hub.disconnect(c, websocket.ClosePolicyViolation, reason)
+}
+
+// Sends a message only to this client
+func (c *Client) Send(message models.WebSocketMessage) {
+	c.sendJSON(message)
+}
+
+func (c *Client) sendJSON(value interface{}) {
+	data, _ := json.Marshal(value)
+	encoded, err := c.encoding.fromJSON(data)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	c.enqueue(encoded)
+}
+
+func (c *Client) Encoding() Encoding {
+	return c.encoding
+}
+
+// Number of messages discarded because the client was not reading fast enough
+func (c *Client) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// Queues the message without blocking, applying the slow consumer policy when the buffer is full
+func (c *Client) enqueue(data []byte) {
+	select {
+	case <-c.done: // The client is gone, the message is discarded
+		return
+	default:
+	}
+
+	select {
+	case c.outbound <- data:
+		return
+	default:
+	}
+
+	switch c.hub.config.SlowConsumerPolicy {
+	case DropOldest:
+		select {
+		case <-c.outbound:
+			c.drop()
+		default:
+		}
+
+		select {
+		case c.outbound <- data:
+		default:
+			c.drop()
+		}
+	case DropNewest:
+		c.drop()
+	case Disconnect:
+		c.drop()
+
+		if c.evicted.CompareAndSwap(false, true) {
+			log.Println("Disconnecting slow client", c.id)
+			// The caller may hold the hub lock. Closed as try again later, so the client tells it apart from a normal close
+			go c.hub.disconnect(c, websocket.CloseTryAgainLater, slowConsumerReason)
+		}
+	}
+}
+
+func (c *Client) drop() {
+	c.dropped.Add(1)
+	c.hub.dropped.Add(1)
+}
+
+func (c *Client) Read() {
+	defer c.hub.leave(c)
+
+	config := c.hub.config
+
+	c.socket.SetReadLimit(config.MaxMessageSize)
+	c.socket.SetReadDeadline(time.Now().Add(config.PongWait))
+	c.socket.SetPongHandler(func(string) error {
+		// Every pong proves the connection is alive, so the deadline is extended
+		return c.socket.SetReadDeadline(time.Now().Add(config.PongWait))
+	})
+
+	for {
+		frameType, data, err := c.socket.ReadMessage()
+
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println(err)
+			}
+			return
+		}
+
+		if c.limiter != nil && !c.limiter.Allow() {
+			c.hub.disconnect(c, websocket.ClosePolicyViolation, ErrRateLimitExceeded.Error())
+			return
+		}
+
+		if frameType == websocket.BinaryMessage {
+			// Turned into JSON, so the binary clients share the handlers with the rest
+			if data, err = c.encoding.toJSON(data); err != nil {
+				c.Send(models.WebSocketMessage{
+					Type:    models.ErrorMessageType,
+					Payload: "Invalid message format",
+				})
+				continue
+			}
+		}
+
+		if isRPCFrame(data) {
+			c.hub.dispatchRPC(c, data)
+			continue
+		}
+
+		var message models.WebSocketMessage
+
+		if err := json.Unmarshal(data, &message); err != nil || message.Type == "" {
+			c.Send(models.WebSocketMessage{
+				Type:    models.ErrorMessageType,
+				Payload: "Invalid message format",
+			})
+			continue
+		}
+
+		c.hub.dispatch(c, &message)
 	}
 }
 
 func (c *Client) Write() {
+	config := c.hub.config
+	ticker := time.NewTicker(config.PingPeriod)
+
+	defer func() {
+		ticker.Stop()
+		c.socket.Close() // Also unblocks the read pump
+		c.hub.pumps.Done()
+	}()
+
 	for {
 		select {
-		case message, ok := <-c.outbound:
-			if !ok {
-				c.socket.WriteMessage(websocket.CloseMessage, []byte{})
-				c.hub.unregister <- c
+		case message := <-c.outbound:
+			c.socket.SetWriteDeadline(time.Now().Add(config.WriteWait))
+
+			if err := c.socket.WriteMessage(c.encoding.frameType(), message); err != nil {
+				c.hub.leave(c)
 				return
 			}
-			if err := c.socket.WriteMessage(websocket.TextMessage, message); err != nil {
-				c.socket.Close()
-				c.hub.unregister <- c
+
+			c.sent.Add(1)
+		case <-ticker.C:
+			c.socket.SetWriteDeadline(time.Now().Add(config.WriteWait))
+
+			if err := c.socket.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.hub.leave(c)
+				return
 			}
+		case <-c.done:
+			c.socket.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeCode, c.closeReason),
+				time.Now().Add(config.WriteWait),
+			)
+			return
 		}
 	}
 }
@@ -0,0 +1,145 @@
+package websockets
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWriteWait          = 10 * time.Second
+	defaultPongWait           = 60 * time.Second
+	defaultOutboundBufferSize = 256
+	defaultReplayBufferSize   = 256
+	defaultPresenceGrace      = 5 * time.Second
+	defaultPresenceHeartbeat  = 30 * time.Second
+	defaultMaxMessageSize     = 64 * 1024
+	defaultAckTimeout         = 10 * time.Second
+	defaultMaxAckRetries      = 3
+	defaultMaxTopicsPerClient = 100
+)
+
+// What to do with a message when the outbound buffer of a client is full
+type SlowConsumerPolicy string
+
+const (
+	DropOldest SlowConsumerPolicy = "drop-oldest" // Discards the oldest queued message to make room for the new one
+	DropNewest SlowConsumerPolicy = "drop-newest" // Discards the new message
+	Disconnect SlowConsumerPolicy = "disconnect"  // Discards the new message and disconnects the client
+)
+
+type HubConfig struct {
+	WriteWait           time.Duration      // Time allowed to write a message to the client
+	PongWait            time.Duration      // Time allowed to receive the next pong from the client
+	PingPeriod          time.Duration      // Time between pings sent to the client, must be less than PongWait
+	OutboundBufferSize  int                // Messages queued per client before the slow consumer policy applies
+	SlowConsumerPolicy  SlowConsumerPolicy // Defaults to DropOldest
+	ReplayBufferSize    int                // Last events kept to fill the gap of the clients that resume
+	PresenceGracePeriod time.Duration      // Time a user stays online after its last connection closes
+	PresenceHeartbeat   time.Duration      // Time between the announcements of the users of this node to the others
+
+	AllowedOrigins    []string // Origins allowed to open a websocket, "*" allows any. Defaults to the same origin only
+	ReadBufferSize    int      // Zero uses the buffers of the HTTP server
+	WriteBufferSize   int
+	MaxMessageSize    int64 // Bigger messages sent by a client close its connection
+	EnableCompression bool  // Negotiates per-message compression with the clients that support it
+
+	MaxConnections        int     // Open connections accepted by the hub, zero for unlimited
+	MaxConnectionsPerUser int     // Open connections accepted for a single user, zero for unlimited
+	InboundRateLimit      float64 // Messages per second a client can send, zero for unlimited
+	InboundBurst          int     // Messages a client can send at once, defaults to the rate limit
+	MaxTopicsPerClient    int     // Topics a client can be subscribed to at once, including the default ones
+
+	AckTimeout    time.Duration // Time to wait for the ack of a message before resending it
+	MaxAckRetries int           // Times a message is resent before giving up on it
+}
+
+// Returns a copy of the config with every unset value replaced by its default
+func (config HubConfig) withDefaults() *HubConfig {
+	if config.WriteWait <= 0 {
+		config.WriteWait = defaultWriteWait
+	}
+
+	if config.PongWait <= 0 {
+		config.PongWait = defaultPongWait
+	}
+
+	if config.PingPeriod <= 0 || config.PingPeriod >= config.PongWait {
+		config.PingPeriod = (config.PongWait * 9) / 10
+	}
+
+	if config.OutboundBufferSize <= 0 {
+		config.OutboundBufferSize = defaultOutboundBufferSize
+	}
+
+	if config.ReplayBufferSize <= 0 {
+		config.ReplayBufferSize = defaultReplayBufferSize
+	}
+
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = defaultMaxMessageSize
+	}
+
+	if config.InboundRateLimit > 0 && config.InboundBurst <= 0 {
+		config.InboundBurst = int(config.InboundRateLimit)
+
+		if config.InboundBurst < 1 {
+			config.InboundBurst = 1
+		}
+	}
+
+	if config.MaxTopicsPerClient <= 0 {
+		config.MaxTopicsPerClient = defaultMaxTopicsPerClient
+	}
+
+	if config.AckTimeout <= 0 {
+		config.AckTimeout = defaultAckTimeout
+	}
+
+	if config.MaxAckRetries <= 0 {
+		config.MaxAckRetries = defaultMaxAckRetries
+	}
+
+	if config.PresenceGracePeriod <= 0 {
+		config.PresenceGracePeriod = defaultPresenceGrace
+	}
+
+	if config.PresenceHeartbeat <= 0 {
+		config.PresenceHeartbeat = defaultPresenceHeartbeat
+	}
+
+	switch config.SlowConsumerPolicy {
+	case DropOldest, DropNewest, Disconnect:
+	default:
+		config.SlowConsumerPolicy = DropOldest
+	}
+
+	return &config
+}
+
+// Builds the function used by the upgrader to accept or reject the origin of a request
+func (config *HubConfig) checkOrigin() func(r *http.Request) bool {
+	for _, origin := range config.AllowedOrigins {
+		if origin == "*" {
+			return func(r *http.Request) bool { return true }
+		}
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+
+		if origin == "" {
+			return true // Not sent by a browser
+		}
+
+		for _, allowed := range config.AllowedOrigins {
+			if strings.EqualFold(origin, strings.TrimSuffix(allowed, "/")) {
+				return true
+			}
+		}
+
+		parsed, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(parsed.Host, r.Host)
+	}
+}
@@ -0,0 +1,117 @@
+package websockets
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Format of the frames exchanged with a client, negotiated through the Sec-WebSocket-Protocol header
+type Encoding string
+
+const (
+	JSONEncoding        Encoding = "json"
+	MessagePackEncoding Encoding = "msgpack"
+	CBOREncoding        Encoding = "cbor"
+)
+
+// Subprotocols accepted by the hub, in order of preference
+var encodingProtocols = []string{string(MessagePackEncoding), string(CBOREncoding), string(JSONEncoding)}
+
+// CBOR maps are decoded with string keys, so they can be turned back into JSON
+var cborDecoder, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}{})}.DecMode()
+
+// Encoding chosen by the client when opening the websocket, JSON if it did not ask for a binary one
+func encodingOf(socket *websocket.Conn) Encoding {
+	switch Encoding(socket.Subprotocol()) {
+	case MessagePackEncoding:
+		return MessagePackEncoding
+	case CBOREncoding:
+		return CBOREncoding
+	default:
+		return JSONEncoding
+	}
+}
+
+// Type of the websocket frames used to send the messages in the encoding
+func (encoding Encoding) frameType() int {
+	if encoding == JSONEncoding {
+		return websocket.TextMessage
+	}
+
+	return websocket.BinaryMessage
+}
+
+// Converts a JSON encoded message to the encoding. The message goes through JSON first,
+// so every encoding uses the same field names
+func (encoding Encoding) fromJSON(data []byte) ([]byte, error) {
+	if encoding == JSONEncoding {
+		return data, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber() // Keeps integers, like the sequence numbers, from becoming floats
+
+	var value interface{}
+
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	value = normalizeNumbers(value)
+
+	if encoding == CBOREncoding {
+		return cbor.Marshal(value)
+	}
+
+	return msgpack.Marshal(value)
+}
+
+// Converts a message received in the encoding to JSON, so it goes through the same handlers
+func (encoding Encoding) toJSON(data []byte) ([]byte, error) {
+	if encoding == JSONEncoding {
+		return data, nil
+	}
+
+	var value interface{}
+	var err error
+
+	if encoding == CBOREncoding {
+		err = cborDecoder.Unmarshal(data, &value)
+	} else {
+		err = msgpack.Unmarshal(data, &value)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(value)
+}
+
+// Replaces the JSON numbers by integers when they have no fraction, or by floats otherwise
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,135 @@
+package websockets
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+)
+
+// Streams the hub events as Server-Sent Events to the user with the given verified claims.
+// Works as a fallback for the clients that can not open a websocket
+func (hub *Hub) HandleEventStream(w http.ResponseWriter, r *http.Request, claims *models.AppClaims) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	client, err := NewClient(hub, nil, claims)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	client.remoteAddr = r.RemoteAddr
+
+	if err := hub.onConnect(client); err != nil {
+		client.cancel()
+		status := http.StatusTooManyRequests
+
+		if err == ErrHubClosed {
+			status = http.StatusServiceUnavailable
+		}
+
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	defer hub.pumps.Done()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Browsers send back the id of the last event received when they reconnect. The stream can not send
+	// subscribe messages, so the topics besides the own user one go in the query, like ?topic=global&topic=post:1
+	payload, resuming := parseEventId(r.Header.Get("Last-Event-ID"))
+
+	if !resuming {
+		payload = ResumePayload{StreamId: hub.streamId, LastSeq: client.connectSeq}
+	}
+
+	payload.Topics = r.URL.Query()["topic"]
+
+	if resuming || len(payload.Topics) > 0 {
+		hub.resume(client, payload)
+	}
+
+	ticker := time.NewTicker(hub.config.PingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case data := <-client.outbound:
+			if err := hub.writeEvent(w, data); err != nil {
+				log.Println(err)
+				hub.leave(client)
+				return
+			}
+			flusher.Flush()
+			client.sent.Add(1)
+		case <-ticker.C:
+			// Comments are ignored by the clients but keep proxies from closing an idle connection
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				hub.leave(client)
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			hub.leave(client)
+			return
+		case <-client.done:
+			return
+		}
+	}
+}
+
+func (hub *Hub) writeEvent(w http.ResponseWriter, data []byte) error {
+	var message struct {
+		Seq uint64 `json:"seq"`
+	}
+
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+
+	// Only the sequenced events get an id, so the Last-Event-ID always points to one of them
+	if message.Seq > 0 {
+		if _, err := fmt.Fprintf(w, "id: %s:%d\n", hub.streamId, message.Seq); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
+
+// Event ids have the "<streamId>:<seq>" format
+func parseEventId(id string) (ResumePayload, bool) {
+	streamId, seq, found := strings.Cut(id, ":")
+
+	if !found {
+		return ResumePayload{}, false
+	}
+
+	lastSeq, err := strconv.ParseUint(seq, 10, 64)
+
+	if err != nil {
+		return ResumePayload{}, false
+	}
+
+	return ResumePayload{
+		StreamId: streamId,
+		LastSeq:  lastSeq,
+	}, true
+}
@@ -1,36 +1,98 @@
 package websockets
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/daluisgarcia/golang-rest-websockets/models"
 	"github.com/gorilla/websocket"
+	"github.com/segmentio/ksuid"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true }, // Allows to restrict the websocket for some clients
-}
+// Handles a message of a given type sent by a client through the websocket
+type MessageHandler func(client *Client, message *models.WebSocketMessage)
 
 type Hub struct {
-	clients    []*Client
-	register   chan *Client
-	unregister chan *Client
-	mutex      *sync.Mutex
+	config          *HubConfig
+	upgrader        *websocket.Upgrader
+	clients         map[string]*Client          // Open connections by client id
+	users           map[string]map[*Client]bool // Open connections by user id
+	topics          map[string]map[*Client]bool // Subscribed clients by topic
+	handlers        map[string]MessageHandler
+	rpcHandlers     map[string]RPCHandler
+	backplane       Backplane
+	streamId        string                       // Identifies the sequence of this hub, which restarts with the node
+	seq             uint64                       // Sequence number of the last delivered event
+	replay          []*sequencedMessage          // Last delivered events, oldest first
+	offlineTimers   map[string]*time.Timer       // Users whose last connection closed, within the presence grace period
+	presence        map[string]*nodePresence     // Users connected to every node, by node id
+	presenceVersion uint64                       // Version of the last presence update of this node
+	listings        map[string]chan *NodeClients // Answers to the ClusterClients calls in progress, by request id
+	unregister      chan *Client
+	stop            chan struct{}   // Closed when the hub shuts down, which ends the Run loop
+	closing         bool            // Set once the hub starts shutting down, no clients are accepted after that
+	pumps           *sync.WaitGroup // Write pumps and event streams still running
+	mutex           *sync.RWMutex   // Guards the hub state
+	dropped         atomic.Uint64   // Messages discarded across every client
+	ackFailures     atomic.Uint64   // Messages never acknowledged after every retry
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		clients:    make([]*Client, 0),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		mutex:      &sync.Mutex{},
+func NewHub(config HubConfig) *Hub {
+	hubConfig := config.withDefaults()
+
+	hub := &Hub{
+		streamId: ksuid.New().String(),
+		config:   hubConfig,
+		upgrader: &websocket.Upgrader{
+			ReadBufferSize:    hubConfig.ReadBufferSize,
+			WriteBufferSize:   hubConfig.WriteBufferSize,
+			EnableCompression: hubConfig.EnableCompression,
+			CheckOrigin:       hubConfig.checkOrigin(),
+			Subprotocols:      append(encodingProtocols, "access_token"), // Encodings are preferred over echoing the token protocol
+		},
+		clients:       make(map[string]*Client),
+		users:         make(map[string]map[*Client]bool),
+		topics:        make(map[string]map[*Client]bool),
+		offlineTimers: make(map[string]*time.Timer),
+		presence:      make(map[string]*nodePresence),
+		listings:      make(map[string]chan *NodeClients),
+		handlers:      make(map[string]MessageHandler),
+		rpcHandlers:   make(map[string]RPCHandler),
+		backplane:     NewMemoryBackplane(),
+		unregister:    make(chan *Client),
+		stop:          make(chan struct{}),
+		pumps:         &sync.WaitGroup{},
+		mutex:         &sync.RWMutex{},
 	}
+
+	hub.HandleMessage(models.SubscribeMessageType, hub.handleSubscribe)
+	hub.HandleMessage(models.UnsubscribeMessageType, hub.handleUnsubscribe)
+	hub.HandleMessage(models.ResumeMessageType, hub.handleResume)
+	hub.HandleMessage(models.AckMessageType, hub.handleAck)
+	hub.backplane.Subscribe(hub.deliver)
+
+	return hub
 }
 
-func (hub *Hub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	socket, err := upgrader.Upgrade(w, r, nil)
+// Replaces the in-memory backplane, so the messages reach the clients connected to other nodes.
+// Must be called before the hub starts running
+func (hub *Hub) UseBackplane(backplane Backplane) error {
+	if err := backplane.Subscribe(hub.deliver); err != nil {
+		return err
+	}
+
+	hub.backplane = backplane
+	return nil
+}
+
+// Upgrades the request to a websocket connection of the user with the given verified claims
+func (hub *Hub) HandleWebSocket(w http.ResponseWriter, r *http.Request, claims *models.AppClaims) {
+	socket, err := hub.upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
 		log.Println(err)
@@ -38,49 +100,280 @@ func (hub *Hub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := NewClient(hub, socket)
-	hub.register <- client
+	client, err := NewClient(hub, socket, claims)
+
+	if err != nil {
+		log.Println(err)
+		socket.Close()
+		return
+	}
+
+	client.remoteAddr = r.RemoteAddr
+
+	// Registered before the pumps start, so no message arrives before it
+	if err := hub.onConnect(client); err != nil {
+		client.cancel()
+		rejectSocket(socket, hub.config.WriteWait, err)
+		return
+	}
 
 	go client.Write()
+	go client.Read()
 }
 
-func (hub *Hub) onConnect(client *Client) {
-	log.Println("Client connected")
+// Registers the handler to be called when a client sends a message of the given type
+func (hub *Hub) HandleMessage(messageType string, handler MessageHandler) {
 	hub.mutex.Lock()
 	defer hub.mutex.Unlock()
-	client.id = client.socket.RemoteAddr().String()
-	hub.clients = append(hub.clients, client)
+	hub.handlers[messageType] = handler
+}
+
+func (hub *Hub) dispatch(client *Client, message *models.WebSocketMessage) {
+	hub.mutex.RLock()
+	handler, ok := hub.handlers[message.Type]
+	hub.mutex.RUnlock()
+
+	if !ok {
+		client.Send(models.WebSocketMessage{
+			Type:    models.ErrorMessageType,
+			Payload: "Unknown message type: " + message.Type,
+		})
+		return
+	}
+
+	handler(client, message)
+}
+
+// Number of messages discarded because clients were not reading fast enough
+func (hub *Hub) DroppedMessages() uint64 {
+	return hub.dropped.Load()
+}
+
+// Registers the client, whose pump must call hub.pumps.Done once it stops
+func (hub *Hub) onConnect(client *Client) error {
+	hub.mutex.Lock()
+
+	if hub.closing {
+		hub.mutex.Unlock()
+		return ErrHubClosed
+	}
+
+	if err := hub.checkConnectionLimits(client.userId); err != nil {
+		hub.mutex.Unlock()
+		return err
+	}
+
+	// Counted along with the closing check, so a shutdown either rejects the client or waits for its pump
+	hub.pumps.Add(1)
+
+	log.Println("Client connected", client.id)
+	hub.clients[client.id] = client
+	client.connectSeq = hub.seq
+
+	if _, ok := hub.users[client.userId]; !ok {
+		hub.users[client.userId] = make(map[*Client]bool)
+	}
+	hub.users[client.userId][client] = true
+	var presence *presenceUpdate
+	if hub.markOnline(client.userId) {
+		presence = hub.nextPresenceUpdate([]string{client.userId}, true, false)
+	}
+
+	// Every client receives the events about their own user by default, the rest of the topics are opt-in
+	hub.addSubscription(client, UserTopic(client.userId))
+
+	if client.claims.ExpiresAt != 0 {
+		client.expiry = time.AfterFunc(time.Until(time.Unix(client.claims.ExpiresAt, 0)), func() {
+			client.Disconnect(tokenExpiredReason)
+		})
+	}
+
+	// Tells the client where the stream is, so it can resume from there after reconnecting
+	client.Send(models.WebSocketMessage{
+		Type: models.ConnectedMessageType,
+		Payload: StreamPosition{
+			ClientId: client.id,
+			StreamId: hub.streamId,
+			Seq:      hub.seq,
+		},
+	})
+
+	hub.mutex.Unlock()
+
+	// Published once the lock is released, since the delivery needs it
+	if presence != nil {
+		hub.publishPresence(presence)
+	}
+
+	return nil
 }
 
 func (hub *Hub) onDisconnect(client *Client) {
-	log.Println("Client disconnected")
-	client.socket.Close()
+	hub.disconnect(client, websocket.CloseNormalClosure, "")
+}
+
+// Removes the client from the hub and closes its connection with the given close code
+func (hub *Hub) disconnect(client *Client, closeCode int, closeReason string) {
 	hub.mutex.Lock()
 	defer hub.mutex.Unlock()
-	for i, c := range hub.clients {
-		if c.id == client.id {
-			hub.clients = append(hub.clients[:i], hub.clients[i+1:]...)
-			break
+	hub.disconnectLocked(client, closeCode, closeReason)
+}
+
+// Must be called with the hub mutex locked
+func (hub *Hub) disconnectLocked(client *Client, closeCode int, closeReason string) {
+	// Both pumps unregister the client when they stop, so it may be already gone
+	if c, ok := hub.clients[client.id]; !ok || c != client {
+		return
+	}
+
+	log.Println("Client disconnected", client.id)
+	delete(hub.clients, client.id)
+
+	delete(hub.users[client.userId], client)
+	if len(hub.users[client.userId]) == 0 {
+		delete(hub.users, client.userId)
+
+		if !hub.closing {
+			hub.scheduleOffline(client.userId)
 		}
 	}
+
+	for topic := range client.topics {
+		hub.removeSubscription(client, topic)
+	}
+
+	client.closeCode = closeCode
+	client.closeReason = closeReason
+	close(client.done) // Stops the write pump, which closes the socket
+	client.cancel()
+
+	if client.expiry != nil {
+		client.expiry.Stop()
+	}
+	client.abandonAcks()
 }
 
+// Removes the clients whose connections are gone and announces the users of this node to the others,
+// until the hub shuts down
 func (hub *Hub) Run() {
+	heartbeat := time.NewTicker(hub.config.PresenceHeartbeat)
+	defer heartbeat.Stop()
+
 	for {
 		select {
-		case client := <-hub.register:
-			hub.onConnect(client)
 		case client := <-hub.unregister:
 			hub.onDisconnect(client)
+		case <-heartbeat.C:
+			hub.presenceHeartbeat()
+		case <-hub.stop:
+			return
+		}
+	}
+}
+
+func (hub *Hub) Broadcast(message models.WebSocketMessage, ignore *Client) {
+	envelope := &Envelope{Kind: BroadcastEnvelope}
+
+	if ignore != nil {
+		envelope.Ignore = ignore.id
+	}
+
+	hub.propagate(envelope, message)
+}
+
+// Sends the message to every open connection of the user, such as multiple tabs or devices
+func (hub *Hub) SendToUser(userId string, message models.WebSocketMessage) {
+	hub.propagate(&Envelope{Kind: UserEnvelope, Targets: []string{userId}}, message)
+}
+
+// Hands the message to the backplane, which delivers it through the hub of every node
+func (hub *Hub) propagate(envelope *Envelope, message models.WebSocketMessage) {
+	if message.RequireAck && message.Id == "" {
+		message.Id = ksuid.New().String()
+	}
+
+	data, err := json.Marshal(message)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	envelope.Message = data
+	hub.publish(envelope)
+}
+
+func (hub *Hub) publish(envelope *Envelope) {
+	if err := hub.backplane.Publish(context.Background(), envelope); err != nil {
+		// At least the clients of this node get the message
+		log.Println("Could not publish to the backplane:", err)
+		hub.deliver(envelope)
+	}
+}
+
+// Handles an envelope received from the backplane
+func (hub *Hub) deliver(envelope *Envelope) {
+	// The lock is held while queueing, which never blocks, so the events reach every client in sequence order
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	switch envelope.Kind {
+	case PresenceEnvelope:
+		hub.applyPresence(envelope)
+	case DisconnectClientEnvelope, DisconnectUserEnvelope, DisconnectTokenEnvelope:
+		hub.applyDisconnect(envelope)
+	case ListClientsEnvelope:
+		// Answered without the lock, since the backplane may deliver the answer back to this hub right away
+		go hub.answerListing(envelope.Targets[0])
+	case ClientsEnvelope:
+		hub.applyListing(envelope)
+	default:
+		hub.deliverLocked(envelope)
+	}
+}
+
+// Queues the message of the envelope to the matching clients connected to this node.
+// Must be called with the hub mutex locked
+func (hub *Hub) deliverLocked(envelope *Envelope) {
+	sequenced, err := hub.sequence(envelope)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, client := range hub.recipients(envelope) {
+		if client.id != envelope.Ignore {
+			client.deliver(sequenced)
 		}
 	}
 }
 
-func (hub *Hub) Broadcast(message interface{}, ignore *Client) {
-	data, _ := json.Marshal(message)
-	for _, client := range hub.clients {
-		if client != ignore {
-			client.outbound <- data
+// Must be called with the hub mutex locked
+func (hub *Hub) recipients(envelope *Envelope) []*Client {
+	recipients := make([]*Client, 0)
+
+	switch envelope.Kind {
+	case BroadcastEnvelope:
+		for _, client := range hub.clients {
+			recipients = append(recipients, client)
+		}
+	case TopicEnvelope:
+		// A client subscribed to several of the topics gets the message once
+		seen := make(map[*Client]bool)
+		for _, topic := range envelope.Targets {
+			for client := range hub.topics[topic] {
+				if !seen[client] {
+					seen[client] = true
+					recipients = append(recipients, client)
+				}
+			}
+		}
+	case UserEnvelope:
+		for client := range hub.users[envelope.Targets[0]] {
+			recipients = append(recipients, client)
 		}
 	}
+
+	return recipients
 }
@@ -0,0 +1,518 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/websocket"
+)
+
+// Starts a hub connected to the backplane, which is shut down once the test ends
+func newTestHub(t *testing.T, backplane *MemoryBackplane) *Hub {
+	t.Helper()
+
+	return newTestHubWithConfig(t, backplane, HubConfig{
+		OutboundBufferSize:  16,
+		PresenceGracePeriod: time.Millisecond,
+	})
+}
+
+func newTestHubWithConfig(t *testing.T, backplane *MemoryBackplane, config HubConfig) *Hub {
+	t.Helper()
+
+	hub := NewHub(config)
+
+	if err := hub.UseBackplane(backplane); err != nil {
+		t.Fatal(err)
+	}
+
+	go hub.Run()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		if err := hub.Shutdown(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+
+	return hub
+}
+
+// Registers a client without a socket, whose messages stay queued in its outbound buffer
+func connectTestClient(t *testing.T, hub *Hub, userId string) *Client {
+	t.Helper()
+
+	client, err := registerTestClient(hub, &models.AppClaims{UserId: userId})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+// Registers a client without a socket, standing in for its pump until the hub unregisters it
+func registerTestClient(hub *Hub, claims *models.AppClaims) (*Client, error) {
+	client, err := NewClient(hub, nil, claims)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hub.onConnect(client); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-client.done
+		hub.pumps.Done()
+	}()
+
+	return client, nil
+}
+
+// Takes the messages queued for the client, counting them by type
+func receivedMessages(t *testing.T, client *Client) map[string]int {
+	t.Helper()
+
+	messages := make(map[string]int)
+
+	for {
+		select {
+		case data := <-client.outbound:
+			var message models.WebSocketMessage
+
+			if err := json.Unmarshal(data, &message); err != nil {
+				t.Fatal(err)
+			}
+
+			messages[message.Type]++
+		default:
+			return messages
+		}
+	}
+}
+
+func TestHubConcurrentConnectDisconnectBroadcast(t *testing.T) {
+	hub := newTestHub(t, NewMemoryBackplane())
+
+	const workers = 16
+	const iterations = 50
+
+	stop := make(chan struct{})
+	background := &sync.WaitGroup{}
+	background.Add(1)
+
+	// Keeps broadcasting while the clients come and go
+	go func() {
+		defer background.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				hub.Broadcast(models.WebSocketMessage{Type: models.AnnouncementMessageType}, nil)
+			}
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func(w int) {
+			defer wg.Done()
+
+			userId := fmt.Sprintf("user-%d", w%4) // Several connections per user
+			topic := PostTopic(fmt.Sprintf("post-%d", w%3))
+
+			for i := 0; i < iterations; i++ {
+				client, err := registerTestClient(hub, &models.AppClaims{UserId: userId})
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				hub.dispatch(client, &models.WebSocketMessage{
+					Type:    models.SubscribeMessageType,
+					Payload: SubscriptionPayload{Topic: topic},
+				})
+
+				hub.Publish(topic, models.WebSocketMessage{Type: models.PostUpdatedMessageType})
+				hub.SendToUser(userId, models.WebSocketMessage{Type: models.PostCreatedMessageType})
+				hub.Broadcast(models.WebSocketMessage{Type: models.PostDeletedMessageType}, client)
+				hub.Clients()
+				hub.OnlineUsers()
+
+				if i%2 == 0 {
+					hub.unsubscribe(client, topic)
+				}
+
+				hub.leave(client)
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(stop)
+	background.Wait()
+
+	// The Run loop may still be removing the last clients handed to it
+	eventually(t, func() bool {
+		hub.mutex.RLock()
+		defer hub.mutex.RUnlock()
+		return len(hub.clients) == 0 && len(hub.users) == 0 && len(hub.topics) == 0
+	})
+}
+
+func TestHubPublishOnlyReachesSubscribers(t *testing.T) {
+	hub := newTestHub(t, NewMemoryBackplane())
+
+	subscriber := connectTestClient(t, hub, "user-1")
+	other := connectTestClient(t, hub, "user-2")
+
+	if err := hub.subscribe(subscriber, PostTopic("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	hub.Publish(PostTopic("1"), models.WebSocketMessage{Type: models.PostUpdatedMessageType})
+
+	if got := receivedMessages(t, subscriber)[models.PostUpdatedMessageType]; got != 1 {
+		t.Fatalf("subscriber got %d messages, expected 1", got)
+	}
+
+	if got := receivedMessages(t, other)[models.PostUpdatedMessageType]; got != 0 {
+		t.Fatalf("other client got %d messages, expected none", got)
+	}
+}
+
+func TestHubsShareTheBackplane(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	first := newTestHub(t, backplane)
+	second := newTestHub(t, backplane)
+
+	sender := connectTestClient(t, first, "user-1")
+	receiver := connectTestClient(t, second, "user-2")
+
+	first.Broadcast(models.WebSocketMessage{Type: models.PostCreatedMessageType}, sender)
+	first.SendToUser("user-2", models.WebSocketMessage{Type: models.AnnouncementMessageType})
+
+	received := receivedMessages(t, receiver)
+
+	if got := received[models.PostCreatedMessageType]; got != 1 {
+		t.Fatalf("client of the other hub got %d broadcasts, expected 1", got)
+	}
+
+	if got := received[models.AnnouncementMessageType]; got != 1 {
+		t.Fatalf("client of the other hub got %d user messages, expected 1", got)
+	}
+
+	if got := receivedMessages(t, sender)[models.PostCreatedMessageType]; got != 0 {
+		t.Fatalf("ignored client got %d broadcasts, expected none", got)
+	}
+}
+
+func TestResumeOnlyReplaysTheEventsBeforeConnecting(t *testing.T) {
+	hub := newTestHub(t, NewMemoryBackplane())
+	connectTestClient(t, hub, "user-1")
+
+	hub.Broadcast(models.WebSocketMessage{Type: models.PostCreatedMessageType}, nil)
+	hub.Broadcast(models.WebSocketMessage{Type: models.PostCreatedMessageType}, nil)
+
+	hub.mutex.RLock()
+	lastSeen := hub.seq - 2
+	hub.mutex.RUnlock()
+
+	// Reconnects after missing the two events, and a new one arrives before it resumes
+	reconnected := connectTestClient(t, hub, "user-1")
+	hub.Broadcast(models.WebSocketMessage{Type: models.PostCreatedMessageType}, nil)
+	hub.resume(reconnected, ResumePayload{StreamId: hub.streamId, LastSeq: lastSeen})
+
+	if got := receivedMessages(t, reconnected)[models.PostCreatedMessageType]; got != 3 {
+		t.Fatalf("reconnected client got %d events, expected each of the 3 once", got)
+	}
+}
+
+func TestResumeReplaysTheTopicsSentAlongSinceConnecting(t *testing.T) {
+	hub := newTestHub(t, NewMemoryBackplane())
+	client := connectTestClient(t, hub, "user-1")
+
+	hub.mutex.RLock()
+	connectSeq := hub.seq
+	hub.mutex.RUnlock()
+
+	// Sent before the client subscribes, the second one also reaches it live through its user topic
+	hub.Publish(PostTopic("1"), models.WebSocketMessage{Type: models.PostUpdatedMessageType})
+	hub.PublishToTopics([]string{UserTopic("user-1"), PostTopic("2")}, models.WebSocketMessage{Type: models.PostUpdatedMessageType})
+	hub.Publish(PostTopic("3"), models.WebSocketMessage{Type: models.PostUpdatedMessageType})
+
+	hub.resume(client, ResumePayload{
+		StreamId: hub.streamId,
+		LastSeq:  connectSeq,
+		Topics:   []string{PostTopic("1"), PostTopic("2")},
+	})
+
+	received := receivedMessages(t, client)
+
+	if got := received[models.PostUpdatedMessageType]; got != 2 {
+		t.Fatalf("client got %d events, expected the ones of both topics once", got)
+	}
+
+	if got := received[models.SubscribedMessageType]; got != 2 {
+		t.Fatalf("client got %d subscription confirmations, expected 2", got)
+	}
+}
+
+// Fails the test unless the condition becomes true within a second
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+
+	t.Fatal("condition not met in time")
+}
+
+func TestPresenceSpansTheHubsOfTheBackplane(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	first := newTestHub(t, backplane)
+	second := newTestHub(t, backplane)
+
+	watcher := connectTestClient(t, second, "user-2")
+
+	if err := second.subscribe(watcher, GlobalTopic); err != nil {
+		t.Fatal(err)
+	}
+	firstTab := connectTestClient(t, first, "user-1")
+	secondTab := connectTestClient(t, second, "user-1")
+
+	// The user with the two tabs, only once
+	if got := receivedMessages(t, watcher)[models.UserOnlineMessageType]; got != 1 {
+		t.Fatalf("watcher got %d online events, expected 1", got)
+	}
+
+	// Still connected to the second hub, so closing the first tab must not take the user offline
+	first.leave(firstTab)
+	eventually(t, func() bool {
+		first.mutex.RLock()
+		defer first.mutex.RUnlock()
+		return len(first.users) == 0 && len(first.offlineTimers) == 0
+	})
+
+	if got := receivedMessages(t, watcher)[models.UserOfflineMessageType]; got != 0 {
+		t.Fatalf("watcher got %d offline events while the user is still online", got)
+	}
+
+	for _, hub := range []*Hub{first, second} {
+		if users := hub.OnlineUsers(); len(users) != 2 {
+			t.Fatalf("hub sees %v online, expected both users", users)
+		}
+	}
+
+	second.leave(secondTab)
+	offline := 0
+	eventually(t, func() bool {
+		offline += receivedMessages(t, watcher)[models.UserOfflineMessageType]
+		return offline > 0
+	})
+
+	if users := first.OnlineUsers(); len(users) != 1 || users[0] != "user-2" {
+		t.Fatalf("first hub sees %v online, expected only user-2", users)
+	}
+}
+
+func TestClientDisconnectedOnceTheTokenExpires(t *testing.T) {
+	hub := newTestHub(t, NewMemoryBackplane())
+
+	client, err := registerTestClient(hub, &models.AppClaims{
+		UserId:         "user-1",
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Second).Unix()},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-client.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("client still connected after its token expired")
+	}
+
+	if client.closeCode != websocket.ClosePolicyViolation || client.closeReason != tokenExpiredReason {
+		t.Fatalf("client closed with %d %q", client.closeCode, client.closeReason)
+	}
+}
+
+func TestAdminDisconnectsReachEveryHub(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	first := newTestHub(t, backplane)
+	second := newTestHub(t, backplane)
+
+	client := connectTestClient(t, second, "user-1")
+	otherTab := connectTestClient(t, second, "user-2")
+	otherDevice := connectTestClient(t, first, "user-2")
+
+	first.DisconnectClient(client.Id())
+	first.DisconnectUser("user-2")
+
+	for _, disconnected := range []*Client{client, otherTab, otherDevice} {
+		select {
+		case <-disconnected.done:
+		default:
+			t.Fatalf("client %s of user %s still connected", disconnected.id, disconnected.userId)
+		}
+
+		if disconnected.closeCode != websocket.ClosePolicyViolation {
+			t.Fatalf("client closed with %d", disconnected.closeCode)
+		}
+	}
+}
+
+func TestRevokedTokenDisconnectsItsClientsOnEveryHub(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	first := newTestHub(t, backplane)
+	second := newTestHub(t, backplane)
+
+	connect := func(hub *Hub, tokenId string) *Client {
+		client, err := registerTestClient(hub, &models.AppClaims{UserId: "user-1", StandardClaims: jwt.StandardClaims{Id: tokenId}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return client
+	}
+
+	revoked := connect(second, "token-1")
+	otherSession := connect(second, "token-2")
+
+	first.DisconnectToken("token-1")
+
+	select {
+	case <-revoked.done:
+	default:
+		t.Fatal("client of the revoked token still connected")
+	}
+
+	select {
+	case <-otherSession.done:
+		t.Fatal("client of another token was disconnected")
+	default:
+	}
+}
+
+func TestShutdownWaitsForTheClientsConnectingMeanwhile(t *testing.T) {
+	hub := newTestHub(t, NewMemoryBackplane())
+
+	connected := make(chan *Client, 1000)
+	wg := &sync.WaitGroup{}
+
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 100; i++ {
+				client, err := registerTestClient(hub, &models.AppClaims{UserId: fmt.Sprintf("user-%d", w)})
+
+				if err == ErrHubClosed {
+					return
+				}
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				connected <- client
+			}
+		}(w)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := hub.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+	close(connected)
+
+	// Every client either was rejected or is disconnected by the time the shutdown returns
+	for client := range connected {
+		select {
+		case <-client.done:
+		default:
+			t.Fatalf("client %s still connected after the shutdown", client.id)
+		}
+	}
+}
+
+func TestConnectionsListedAcrossHubs(t *testing.T) {
+	backplane := NewMemoryBackplane()
+	first := newTestHub(t, backplane)
+	second := newTestHub(t, backplane)
+
+	connectTestClient(t, first, "user-1")
+	remote := connectTestClient(t, second, "user-2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	nodes, missing := first.ClusterClients(ctx)
+
+	if len(missing) != 0 || len(nodes) != 2 {
+		t.Fatalf("listed %d nodes, %v did not answer", len(nodes), missing)
+	}
+
+	listed := false
+	for _, node := range nodes {
+		for _, client := range node.Clients {
+			listed = listed || (node.Node == second.streamId && client.Id == remote.id)
+		}
+	}
+
+	if !listed {
+		t.Fatal("client of the other hub not listed")
+	}
+}
+
+func TestSlowConsumerDisconnectedAsTryAgainLater(t *testing.T) {
+	hub := newTestHubWithConfig(t, NewMemoryBackplane(), HubConfig{
+		OutboundBufferSize: 2,
+		SlowConsumerPolicy: Disconnect,
+	})
+
+	client := connectTestClient(t, hub, "user-1")
+
+	// The connected message and the first one fill the buffer
+	hub.SendToUser("user-1", models.WebSocketMessage{Type: models.AnnouncementMessageType})
+	hub.SendToUser("user-1", models.WebSocketMessage{Type: models.AnnouncementMessageType})
+
+	select {
+	case <-client.done:
+	case <-time.After(time.Second):
+		t.Fatal("slow client still connected")
+	}
+
+	if client.closeCode != websocket.CloseTryAgainLater || client.closeReason != slowConsumerReason {
+		t.Fatalf("client closed with %d %q", client.closeCode, client.closeReason)
+	}
+}
@@ -0,0 +1,91 @@
+package websockets
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrTooManyConnections     = errors.New("too many connections")
+	ErrTooManyUserConnections = errors.New("too many connections for the user")
+	ErrRateLimitExceeded      = errors.New("message rate limit exceeded")
+	ErrTooManyTopics          = errors.New("too many topics")
+)
+
+// Token bucket refilled at a constant rate, allowing bursts up to its capacity
+type rateLimiter struct {
+	rate     float64 // Tokens added per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+	mutex    *sync.Mutex
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:     rate,
+		capacity: float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Takes a token from the bucket, returns false when there is none left
+func (l *rateLimiter) Allow() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	l.last = now
+
+	if l.tokens > l.capacity {
+		l.tokens = l.capacity
+	}
+
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
+
+// Tells if one more connection of the user fits in the limits. Must be called with the hub mutex locked
+func (hub *Hub) checkConnectionLimits(userId string) error {
+	if hub.config.MaxConnections > 0 && len(hub.clients) >= hub.config.MaxConnections {
+		return ErrTooManyConnections
+	}
+
+	if hub.config.MaxConnectionsPerUser > 0 && len(hub.users[userId]) >= hub.config.MaxConnectionsPerUser {
+		return ErrTooManyUserConnections
+	}
+
+	return nil
+}
+
+// Sends a close frame explaining why a socket did not make it into the hub
+func rejectSocket(socket *websocket.Conn, writeWait time.Duration, err error) {
+	socket.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(closeCodeFor(err), err.Error()),
+		time.Now().Add(writeWait),
+	)
+	socket.Close()
+}
+
+// Close code sent to a socket rejected with the given error
+func closeCodeFor(err error) int {
+	switch err {
+	case ErrHubClosed:
+		return websocket.CloseGoingAway
+	case ErrTooManyConnections:
+		return websocket.CloseTryAgainLater
+	default:
+		return websocket.ClosePolicyViolation
+	}
+}
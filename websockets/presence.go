@@ -0,0 +1,256 @@
+package websockets
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+)
+
+// Heartbeats a node can miss before the others consider its users gone, like after a crash
+const presenceMissedHeartbeats = 3
+
+type PresencePayload struct {
+	UserId string `json:"userId"`
+}
+
+// Users connected to a node, as last announced by it through the backplane
+type nodePresence struct {
+	users    map[string]bool
+	version  uint64    // Version of the last update applied, the older ones arrive late and are ignored
+	lastSeen time.Time // Time of the last update received from the node
+}
+
+// Change of the users connected to a node. Every hub applies the updates of every node, including its own,
+// in the same order, so all of them agree on when a user comes online or goes offline
+type presenceUpdate struct {
+	Node     string   `json:"node"`
+	Version  uint64   `json:"version"`
+	Users    []string `json:"users"`
+	Online   bool     `json:"online"`   // Ignored by the snapshots
+	Snapshot bool     `json:"snapshot"` // The users are every user of the node, replacing the previous ones
+}
+
+// Tells if the user just came online with its first connection. Must be called with the hub mutex locked
+func (hub *Hub) markOnline(userId string) bool {
+	if timer, ok := hub.offlineTimers[userId]; ok {
+		// The user reconnected within the grace period, like when reloading a tab, so it never went offline
+		timer.Stop()
+		delete(hub.offlineTimers, userId)
+		return false
+	}
+
+	return len(hub.users[userId]) == 1
+}
+
+// Marks the user offline after the grace period, unless it reconnects meanwhile.
+// Must be called with the hub mutex locked, once the last connection of the user is gone
+func (hub *Hub) scheduleOffline(userId string) {
+	var timer *time.Timer
+
+	timer = time.AfterFunc(hub.config.PresenceGracePeriod, func() {
+		hub.mutex.Lock()
+		current, ok := hub.offlineTimers[userId]
+		if !ok || current != timer {
+			hub.mutex.Unlock()
+			return
+		}
+		delete(hub.offlineTimers, userId)
+		update := hub.nextPresenceUpdate([]string{userId}, false, false)
+		hub.mutex.Unlock()
+
+		hub.publishPresence(update)
+	})
+
+	hub.offlineTimers[userId] = timer
+}
+
+// Versions a change of the users of this node. Must be called with the hub mutex locked, along with the change
+func (hub *Hub) nextPresenceUpdate(users []string, online bool, snapshot bool) *presenceUpdate {
+	hub.presenceVersion++
+
+	return &presenceUpdate{
+		Node:     hub.streamId,
+		Version:  hub.presenceVersion,
+		Users:    users,
+		Online:   online,
+		Snapshot: snapshot,
+	}
+}
+
+// Every user connected to this node, including the ones within the grace period of a disconnection.
+// Must be called with the hub mutex locked
+func (hub *Hub) localUsers() []string {
+	users := make([]string, 0, len(hub.users)+len(hub.offlineTimers))
+	for userId := range hub.users {
+		users = append(users, userId)
+	}
+	for userId := range hub.offlineTimers {
+		users = append(users, userId)
+	}
+
+	return users
+}
+
+// Sends the update to the hub of every node, including this one
+func (hub *Hub) publishPresence(update *presenceUpdate) {
+	data, err := json.Marshal(update)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	hub.publish(&Envelope{Kind: PresenceEnvelope, Message: data})
+}
+
+// Announces every user of this node, so the nodes that just started learn about them and the rest
+// know this node is alive. Also forgets the nodes that stopped announcing themselves
+func (hub *Hub) presenceHeartbeat() {
+	hub.mutex.Lock()
+	update := hub.nextPresenceUpdate(hub.localUsers(), true, true)
+	hub.expirePresence(time.Now())
+	hub.mutex.Unlock()
+
+	hub.publishPresence(update)
+}
+
+// Applies the presence update of a node. Must be called with the hub mutex locked
+func (hub *Hub) applyPresence(envelope *Envelope) {
+	var update presenceUpdate
+
+	if err := json.Unmarshal(envelope.Message, &update); err != nil {
+		log.Println(err)
+		return
+	}
+
+	node, ok := hub.presence[update.Node]
+	if !ok {
+		node = &nodePresence{users: make(map[string]bool)}
+		hub.presence[update.Node] = node
+	}
+
+	node.lastSeen = time.Now()
+
+	if update.Version <= node.version {
+		return // The state of the node already includes it
+	}
+
+	node.version = update.Version
+
+	affected := update.Users
+	if update.Snapshot {
+		for userId := range node.users {
+			affected = append(affected, userId)
+		}
+	}
+
+	wasOnline := make(map[string]bool, len(affected))
+	for _, userId := range affected {
+		wasOnline[userId] = hub.isOnline(userId)
+	}
+
+	if update.Snapshot {
+		node.users = make(map[string]bool, len(update.Users))
+	}
+
+	for _, userId := range update.Users {
+		if update.Online || update.Snapshot {
+			node.users[userId] = true
+		} else {
+			delete(node.users, userId)
+		}
+	}
+
+	hub.announceChanges(wasOnline)
+}
+
+// Forgets the nodes that missed too many heartbeats. Must be called with the hub mutex locked
+func (hub *Hub) expirePresence(now time.Time) {
+	wasOnline := make(map[string]bool)
+
+	for nodeId, node := range hub.presence {
+		if nodeId == hub.streamId || now.Sub(node.lastSeen) < presenceMissedHeartbeats*hub.config.PresenceHeartbeat {
+			continue
+		}
+
+		for userId := range node.users {
+			wasOnline[userId] = true
+		}
+
+		delete(hub.presence, nodeId)
+	}
+
+	hub.announceChanges(wasOnline)
+}
+
+// Tells the clients of this node about the users that came online or went offline on any node.
+// Must be called with the hub mutex locked
+func (hub *Hub) announceChanges(wasOnline map[string]bool) {
+	users := make([]string, 0, len(wasOnline))
+	for userId := range wasOnline {
+		users = append(users, userId)
+	}
+	sort.Strings(users)
+
+	for _, userId := range users {
+		online := hub.isOnline(userId)
+
+		if online == wasOnline[userId] {
+			continue
+		}
+
+		messageType := models.UserOfflineMessageType
+		if online {
+			messageType = models.UserOnlineMessageType
+		}
+
+		data, err := json.Marshal(models.WebSocketMessage{
+			Type:    messageType,
+			Payload: PresencePayload{UserId: userId},
+		})
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		// Every node announces the change to its own clients, so it is not propagated again
+		hub.deliverLocked(&Envelope{Kind: TopicEnvelope, Targets: []string{GlobalTopic}, Message: data})
+	}
+}
+
+// Tells if the user is connected to any node. Must be called with the hub mutex locked
+func (hub *Hub) isOnline(userId string) bool {
+	for _, node := range hub.presence {
+		if node.users[userId] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Ids of the users connected to any node, including the ones within the grace period of a disconnection.
+// A node that just started learns about the users of the others within a heartbeat
+func (hub *Hub) OnlineUsers() []string {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	online := make(map[string]bool)
+	for _, node := range hub.presence {
+		for userId := range node.users {
+			online[userId] = true
+		}
+	}
+
+	users := make([]string, 0, len(online))
+	for userId := range online {
+		users = append(users, userId)
+	}
+
+	sort.Strings(users)
+	return users
+}
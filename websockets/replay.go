@@ -0,0 +1,252 @@
+package websockets
+
+import (
+	"encoding/json"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+)
+
+type sequencedMessage struct {
+	seq      uint64
+	envelope *Envelope
+	data     []byte              // JSON encoded message including the sequence number
+	encoded  map[Encoding][]byte // The message in the other encodings, guarded by the hub mutex
+	ackId    string              // Empty when the message does not require an ack
+}
+
+// Returns the message in the given encoding, which is converted only once for all the clients using it.
+// Must be called with the hub mutex locked
+func (sequenced *sequencedMessage) encode(encoding Encoding) ([]byte, error) {
+	if encoding == JSONEncoding {
+		return sequenced.data, nil
+	}
+
+	if data, ok := sequenced.encoded[encoding]; ok {
+		return data, nil
+	}
+
+	data, err := encoding.fromJSON(sequenced.data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if sequenced.encoded == nil {
+		sequenced.encoded = make(map[Encoding][]byte)
+	}
+
+	sequenced.encoded[encoding] = data
+	return data, nil
+}
+
+// Position of the event stream of a hub, sent on connect and when a resume is not possible
+type StreamPosition struct {
+	ClientId string `json:"clientId,omitempty"`
+	StreamId string `json:"streamId"`
+	Seq      uint64 `json:"seq"`
+}
+
+type ResumePayload struct {
+	StreamId string   `json:"streamId"`
+	LastSeq  uint64   `json:"lastSeq"`
+	Topics   []string `json:"topics,omitempty"` // Subscribed along with the resume, so their events since connecting are replayed too
+}
+
+// Numbers the message of the envelope and keeps it for replay. Must be called with the hub mutex locked
+func (hub *Hub) sequence(envelope *Envelope) (*sequencedMessage, error) {
+	var message struct {
+		Type       string          `json:"type"`
+		Payload    json.RawMessage `json:"payload"`
+		Id         string          `json:"id"`
+		RequireAck bool            `json:"requireAck"`
+	}
+
+	if err := json.Unmarshal(envelope.Message, &message); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(models.WebSocketMessage{
+		Type:       message.Type,
+		Payload:    message.Payload,
+		Seq:        hub.seq + 1,
+		Id:         message.Id,
+		RequireAck: message.RequireAck,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	hub.seq++
+	sequenced := &sequencedMessage{
+		seq:      hub.seq,
+		envelope: envelope,
+		data:     data,
+	}
+
+	if message.RequireAck {
+		sequenced.ackId = message.Id
+	}
+
+	hub.replay = append(hub.replay, sequenced)
+
+	if len(hub.replay) > hub.config.ReplayBufferSize {
+		hub.replay[0] = nil // Allows the garbage collector to free the message
+		hub.replay = hub.replay[1:]
+	}
+
+	return sequenced, nil
+}
+
+// Tells if the client would have received the event when it was delivered
+func (c *Client) accepts(envelope *Envelope) bool {
+	switch envelope.Kind {
+	case BroadcastEnvelope:
+		return true
+	case TopicEnvelope:
+		for _, topic := range envelope.Targets {
+			if c.topics[topic] {
+				return true
+			}
+		}
+	case UserEnvelope:
+		return c.userId == envelope.Targets[0]
+	}
+
+	return false
+}
+
+func (hub *Hub) handleResume(client *Client, message *models.WebSocketMessage) {
+	var payload ResumePayload
+
+	if err := message.DecodePayload(&payload); err != nil {
+		client.Send(models.WebSocketMessage{
+			Type:    models.ErrorMessageType,
+			Payload: "Invalid resume request",
+		})
+		return
+	}
+
+	hub.resume(client, payload)
+}
+
+// Tells if the event reaches the client only through the topics just added, so it was not delivered live
+func (c *Client) acceptsOnlyThrough(envelope *Envelope, added map[string]bool) bool {
+	if envelope.Kind != TopicEnvelope {
+		return false
+	}
+
+	through := false
+	for _, topic := range envelope.Targets {
+		if added[topic] {
+			through = true
+		} else if c.topics[topic] {
+			return false
+		}
+	}
+
+	return through
+}
+
+// Subscribes the client to the topics sent along with a resume, returning the ones it was not subscribed to.
+// Must be called with the hub mutex locked
+func (hub *Hub) subscribeOnResume(client *Client, topics []string) map[string]bool {
+	added := make(map[string]bool)
+
+	for _, topic := range topics {
+		if !isValidTopic(topic) {
+			client.Send(models.WebSocketMessage{
+				Type:    models.ErrorMessageType,
+				Payload: "Invalid topic",
+			})
+			continue
+		}
+
+		if !canSubscribe(client, topic) {
+			client.Send(models.WebSocketMessage{
+				Type:    models.ErrorMessageType,
+				Payload: "Not allowed to subscribe to the topic",
+			})
+			continue
+		}
+
+		if client.topics[topic] {
+			continue
+		}
+
+		if len(client.topics) >= hub.config.MaxTopicsPerClient {
+			client.Send(models.WebSocketMessage{
+				Type:    models.ErrorMessageType,
+				Payload: "Could not subscribe: " + ErrTooManyTopics.Error(),
+			})
+			continue
+		}
+
+		hub.addSubscription(client, topic)
+		added[topic] = true
+
+		client.Send(models.WebSocketMessage{
+			Type:    models.SubscribedMessageType,
+			Payload: SubscriptionPayload{Topic: topic},
+		})
+	}
+
+	return added
+}
+
+// Subscribes the client to the topics of the resume and queues the events it missed, or asks it to resync when
+// they are gone. Those are the events between the last one it saw and its connection, plus the ones since its
+// connection of the topics just added. The rest of the events after the connection were already delivered to it
+func (hub *Hub) resume(client *Client, payload ResumePayload) {
+	// Holding the lock keeps new events from being queued in between the subscriptions and the replayed events
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	added := hub.subscribeOnResume(client, payload.Topics)
+
+	upTo := client.connectSeq
+	if len(added) > 0 {
+		upTo = hub.seq
+	}
+
+	missed := make([]*sequencedMessage, 0)
+	available := payload.StreamId == hub.streamId && payload.LastSeq <= hub.seq
+
+	if available && payload.LastSeq < upTo {
+		// The events right after the last one seen by the client must still be in the buffer
+		available = len(hub.replay) > 0 && hub.replay[0].seq <= payload.LastSeq+1
+	}
+
+	if available {
+		for _, sequenced := range hub.replay {
+			if sequenced.seq <= payload.LastSeq || sequenced.seq > upTo {
+				continue
+			}
+
+			beforeConnecting := sequenced.seq <= client.connectSeq
+
+			if (beforeConnecting && client.accepts(sequenced.envelope)) ||
+				(!beforeConnecting && client.acceptsOnlyThrough(sequenced.envelope, added)) {
+				missed = append(missed, sequenced)
+			}
+		}
+
+		// Replaying more than the client can queue would drop some of the events anyway
+		available = len(missed) <= cap(client.outbound)-len(client.outbound)
+	}
+
+	if !available {
+		client.Send(models.WebSocketMessage{
+			Type: models.ResyncMessageType,
+			Payload: StreamPosition{
+				StreamId: hub.streamId,
+				Seq:      hub.seq,
+			},
+		})
+		return
+	}
+
+	for _, sequenced := range missed {
+		client.deliver(sequenced)
+	}
+}
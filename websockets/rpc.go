@@ -0,0 +1,174 @@
+package websockets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+)
+
+const JSONRPCVersion = "2.0"
+
+// Error codes of the JSON-RPC 2.0 spec, the -32000 to -32099 range is left for the application
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+	RPCUnauthorized   = -32001
+	RPCNotFound       = -32004
+	RPCForbidden      = -32003
+)
+
+type RPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Id      json.RawMessage `json:"id,omitempty"` // Missing on notifications, which get no response
+}
+
+type RPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func NewRPCError(code int, message string) *RPCError {
+	return &RPCError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Handles a JSON-RPC method called by a client, the result is sent back when there is no error.
+// The context is cancelled once the client disconnects
+type RPCHandler func(ctx context.Context, client *Client, params json.RawMessage) (interface{}, *RPCError)
+
+// Registers the handler to be called when a client calls the JSON-RPC method
+func (hub *Hub) HandleRPC(method string, handler RPCHandler) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.rpcHandlers[method] = handler
+}
+
+// Tells if the frame sent by a client is a JSON-RPC request or a batch of them
+func isRPCFrame(data []byte) bool {
+	data = bytes.TrimSpace(data)
+
+	if len(data) > 0 && data[0] == '[' {
+		return true
+	}
+
+	var probe struct {
+		JSONRPC string `json:"jsonrpc"`
+	}
+
+	return json.Unmarshal(data, &probe) == nil && probe.JSONRPC != ""
+}
+
+func (hub *Hub) dispatchRPC(client *Client, data []byte) {
+	data = bytes.TrimSpace(data)
+
+	if len(data) > 0 && data[0] == '[' {
+		var batch []json.RawMessage
+
+		if err := json.Unmarshal(data, &batch); err != nil {
+			client.sendJSON(rpcFailure(nil, NewRPCError(RPCParseError, "Parse error")))
+			return
+		}
+
+		if len(batch) == 0 {
+			client.sendJSON(rpcFailure(nil, NewRPCError(RPCInvalidRequest, "Invalid Request")))
+			return
+		}
+
+		responses := make([]*RPCResponse, 0, len(batch))
+		for _, request := range batch {
+			if response := hub.callRPC(client, request); response != nil {
+				responses = append(responses, response)
+			}
+		}
+
+		// A batch of notifications gets no response at all
+		if len(responses) > 0 {
+			client.sendJSON(responses)
+		}
+		return
+	}
+
+	if response := hub.callRPC(client, data); response != nil {
+		client.sendJSON(response)
+	}
+}
+
+// Runs a single request, returns nil for notifications
+func (hub *Hub) callRPC(client *Client, data []byte) *RPCResponse {
+	var request RPCRequest
+
+	if err := json.Unmarshal(data, &request); err != nil {
+		if json.Valid(data) {
+			return rpcFailure(nil, NewRPCError(RPCInvalidRequest, "Invalid Request")) // Like a number in a batch
+		}
+
+		return rpcFailure(nil, NewRPCError(RPCParseError, "Parse error"))
+	}
+
+	if request.JSONRPC != JSONRPCVersion || request.Method == "" {
+		return rpcFailure(request.Id, NewRPCError(RPCInvalidRequest, "Invalid Request"))
+	}
+
+	hub.mutex.RLock()
+	handler, ok := hub.rpcHandlers[request.Method]
+	hub.mutex.RUnlock()
+
+	var result interface{}
+	var rpcErr *RPCError
+
+	if ok {
+		result, rpcErr = handler(client.ctx, client, request.Params)
+	} else {
+		rpcErr = NewRPCError(RPCMethodNotFound, "Method not found")
+	}
+
+	if request.Id == nil {
+		return nil
+	}
+
+	if rpcErr != nil {
+		return rpcFailure(request.Id, rpcErr)
+	}
+
+	return &RPCResponse{
+		JSONRPC: JSONRPCVersion,
+		Result:  rpcResult(result),
+		Id:      request.Id,
+	}
+}
+
+func rpcFailure(id json.RawMessage, rpcErr *RPCError) *RPCResponse {
+	if id == nil {
+		id = json.RawMessage("null") // Required by the spec when the id could not be read
+	}
+
+	return &RPCResponse{
+		JSONRPC: JSONRPCVersion,
+		Error:   rpcErr,
+		Id:      id,
+	}
+}
+
+// The result member is required on success, so a nil result is sent as null
+func rpcResult(result interface{}) interface{} {
+	if result == nil {
+		return json.RawMessage("null")
+	}
+
+	return result
+}
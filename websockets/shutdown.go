@@ -0,0 +1,78 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrHubClosed = errors.New("hub is shutting down")
+
+// Removes the client from the hub, used by the pumps when they stop
+func (hub *Hub) leave(client *Client) {
+	select {
+	case hub.unregister <- client:
+	case <-hub.stop:
+		hub.onDisconnect(client) // The Run loop is gone, but the clients must be removed anyway
+	}
+}
+
+// Disconnects every client with a going away close frame, stops the hub and closes the backplane.
+// Waits for the close frames to be sent until the context is done
+func (hub *Hub) Shutdown(ctx context.Context) error {
+	hub.mutex.Lock()
+
+	if hub.closing {
+		hub.mutex.Unlock()
+		return nil
+	}
+
+	hub.closing = true
+
+	clients := make([]*Client, 0, len(hub.clients))
+	for _, client := range hub.clients {
+		clients = append(clients, client)
+	}
+
+	// The users of this node go offline at once, without waiting for the grace period
+	for userId, timer := range hub.offlineTimers {
+		timer.Stop()
+		delete(hub.offlineTimers, userId)
+	}
+
+	hub.mutex.Unlock()
+
+	for _, client := range clients {
+		hub.disconnect(client, websocket.CloseGoingAway, "Server shutting down")
+	}
+
+	// Tells the other nodes this one has no users left, before the backplane is closed
+	hub.mutex.Lock()
+	presence := hub.nextPresenceUpdate([]string{}, false, true)
+	hub.mutex.Unlock()
+
+	hub.publishPresence(presence)
+
+	close(hub.stop)
+
+	drained := make(chan struct{})
+	go func() {
+		hub.pumps.Wait()
+		close(drained)
+	}()
+
+	var err error
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if closeErr := hub.backplane.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
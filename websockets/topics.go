@@ -0,0 +1,152 @@
+package websockets
+
+import (
+	"strings"
+
+	"github.com/daluisgarcia/golang-rest-websockets/models"
+)
+
+// Topic with the events about every user, such as them coming online. Only for the clients subscribing to it
+const GlobalTopic = "global"
+
+// Topic with the activity of a user, such as the posts they create
+func UserTopic(userId string) string {
+	return "user:" + userId
+}
+
+// Topic with the events of a single post
+func PostTopic(postId string) string {
+	return "post:" + postId
+}
+
+func isValidTopic(topic string) bool {
+	if topic == GlobalTopic {
+		return true
+	}
+
+	for _, prefix := range []string{"user:", "post:"} {
+		if strings.HasPrefix(topic, prefix) && len(topic) > len(prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type SubscriptionPayload struct {
+	Topic string `json:"topic"`
+}
+
+// Tells if the client is allowed to receive the events of the topic, the activity of a user is only for themselves
+func canSubscribe(client *Client, topic string) bool {
+	if strings.HasPrefix(topic, "user:") {
+		return topic == UserTopic(client.userId)
+	}
+
+	return true
+}
+
+func (hub *Hub) subscribe(client *Client, topic string) error {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	if !client.topics[topic] && len(client.topics) >= hub.config.MaxTopicsPerClient {
+		return ErrTooManyTopics
+	}
+
+	hub.addSubscription(client, topic)
+	return nil
+}
+
+// Must be called with the hub mutex locked
+func (hub *Hub) addSubscription(client *Client, topic string) {
+	subscribers, ok := hub.topics[topic]
+	if !ok {
+		subscribers = make(map[*Client]bool)
+		hub.topics[topic] = subscribers
+	}
+
+	subscribers[client] = true
+	client.topics[topic] = true
+}
+
+func (hub *Hub) unsubscribe(client *Client, topic string) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.removeSubscription(client, topic)
+}
+
+// Must be called with the hub mutex locked
+func (hub *Hub) removeSubscription(client *Client, topic string) {
+	delete(client.topics, topic)
+
+	if subscribers, ok := hub.topics[topic]; ok {
+		delete(subscribers, client)
+
+		if len(subscribers) == 0 {
+			delete(hub.topics, topic)
+		}
+	}
+}
+
+// Sends the message only to the clients subscribed to the topic
+func (hub *Hub) Publish(topic string, message models.WebSocketMessage) {
+	hub.PublishToTopics([]string{topic}, message)
+}
+
+// Sends the message once to every client subscribed to any of the topics
+func (hub *Hub) PublishToTopics(topics []string, message models.WebSocketMessage) {
+	hub.propagate(&Envelope{Kind: TopicEnvelope, Targets: topics}, message)
+}
+
+func (hub *Hub) handleSubscribe(client *Client, message *models.WebSocketMessage) {
+	var payload SubscriptionPayload
+
+	if err := message.DecodePayload(&payload); err != nil || !isValidTopic(payload.Topic) {
+		client.Send(models.WebSocketMessage{
+			Type:    models.ErrorMessageType,
+			Payload: "Invalid topic",
+		})
+		return
+	}
+
+	if !canSubscribe(client, payload.Topic) {
+		client.Send(models.WebSocketMessage{
+			Type:    models.ErrorMessageType,
+			Payload: "Not allowed to subscribe to the topic",
+		})
+		return
+	}
+
+	if err := hub.subscribe(client, payload.Topic); err != nil {
+		client.Send(models.WebSocketMessage{
+			Type:    models.ErrorMessageType,
+			Payload: "Could not subscribe: " + err.Error(),
+		})
+		return
+	}
+
+	client.Send(models.WebSocketMessage{
+		Type:    models.SubscribedMessageType,
+		Payload: payload,
+	})
+}
+
+func (hub *Hub) handleUnsubscribe(client *Client, message *models.WebSocketMessage) {
+	var payload SubscriptionPayload
+
+	if err := message.DecodePayload(&payload); err != nil || !isValidTopic(payload.Topic) {
+		client.Send(models.WebSocketMessage{
+			Type:    models.ErrorMessageType,
+			Payload: "Invalid topic",
+		})
+		return
+	}
+
+	hub.unsubscribe(client, payload.Topic)
+
+	client.Send(models.WebSocketMessage{
+		Type:    models.UnsubscribedMessageType,
+		Payload: payload,
+	})
+}